@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
@@ -9,8 +10,31 @@ import (
 
 // MergeCandidateBranchPrefix is the prefix in a branch name which identifies
 // it as a merge candidate branch.
+// Merge candidate branches are named "merge-candidate/<base>/<pr>-<counter>",
+// so that the merge queues of several base branches of a repo don't mix up
+// their branches. Earlier versions named them "merge-candidate-<pr>-<counter>",
+// see LegacyBranchName.
 const MergeCandidateBranchPrefix = "merge-candidate"
 
+// MergeCandidateTrailer is the git trailer which identifies the commit at the
+// head of a merge candidate branch, its value is the BranchKey.
+const MergeCandidateTrailer = "Merge-Candidate"
+
+// MergeCandidateOntoTrailer is the git trailer which records the commit a
+// merge candidate branch was created at, for merge strategies in which this
+// commit is not a direct parent of the head of the branch.
+const MergeCandidateOntoTrailer = "Merge-Candidate-Onto"
+
+// MergeCandidateHeadTrailer is the git trailer which records the head of the
+// pull request which was merged into a merge candidate branch.
+const MergeCandidateHeadTrailer = "Merge-Candidate-Head"
+
+// MergeCandidateBatchTrailer is the git trailer which records the number and
+// the head of a pull request which was merged into a merge candidate branch
+// along with the one identifying it, as part of a batch. There is one such
+// trailer for each additional pull request in the batch.
+const MergeCandidateBatchTrailer = "Merge-Candidate-Batch"
+
 // PullRequestNumber uniquely identifies a pull request.
 type PullRequestNumber int
 
@@ -23,15 +47,152 @@ type BranchKey struct {
 	PullRequestNumber PullRequestNumber
 }
 
+// PullRequestRef identifies a pull request which another pull request
+// depends on, in any github repo.
+type PullRequestRef struct {
+	// Repo is the github repo, as "owner/repo", or empty for the repo of the
+	// pull request which depends on it.
+	Repo   string
+	Number PullRequestNumber
+}
+
+// String returns the reference to the pull request as "owner/repo#123", or as
+// "#123" in the same repo.
+func (r PullRequestRef) String() string {
+	return fmt.Sprintf("%s#%d", r.Repo, r.Number)
+}
+
+// ParsePullRequestRef parses a reference to a pull request as
+// "owner/repo#123", or as "#123" in the same repo.
+func ParsePullRequestRef(s string) (r PullRequestRef, isValid bool) {
+	parts := strings.Split(s, "#")
+	if len(parts) != 2 {
+		return r, false
+	}
+	if parts[0] != "" {
+		repo := strings.Split(parts[0], "/")
+		if len(repo) != 2 || repo[0] == "" || repo[1] == "" {
+			return r, false
+		}
+	}
+	num, err := strconv.Atoi(parts[1])
+	if err != nil || num <= 0 {
+		return r, false
+	}
+	return PullRequestRef{Repo: parts[0], Number: PullRequestNumber(num)}, true
+}
+
+// DependencyStatus is the status of a pull request which another one depends
+// on, see GithubClient.GetDependencyStatus.
+type DependencyStatus string
+
+const (
+	// DependencyPending is the status of a dependency which is still to be
+	// merged.
+	DependencyPending DependencyStatus = "pending"
+	// DependencyMerged is the status of a dependency which was merged into its
+	// base branch.
+	DependencyMerged DependencyStatus = "merged"
+	// DependencyCancelled is the status of a dependency which was closed
+	// without being merged, or whose merge was cancelled.
+	DependencyCancelled DependencyStatus = "cancelled"
+	// DependencyFailed is the status of a dependency for which the check
+	// suites failed on all of its merge candidate branches.
+	DependencyFailed DependencyStatus = "failed"
+	// DependencyInvalid is the status of a dependency which doesn't exist, or
+	// which isn't accessible with the github token of the merge queue.
+	DependencyInvalid DependencyStatus = "invalid"
+)
+
+// MergeResult is the result of merging pull requests into a merge candidate
+// branch, see GithubClient.MergeBranch.
+type MergeResult string
+
+const (
+	// Merged is the result of a merge which succeeded.
+	Merged MergeResult = "merged"
+	// MergeConflict is the result of a merge which failed because of a merge
+	// conflict.
+	MergeConflict MergeResult = "conflict"
+	// MergeStaleHead is the result of a merge which wasn't attempted because
+	// the head of a pull request changed since it was fetched. This isn't a
+	// conflict: the next run of the state machine picks up the new head.
+	MergeStaleHead MergeResult = "stale head"
+)
+
+// MergedPullRequest identifies the head of a pull request which is merged into
+// a merge candidate branch.
+type MergedPullRequest struct {
+	Number PullRequestNumber
+	Head   CommitID
+}
+
 // BranchValue stores all the necessary data for a merge candidate branch.
 type BranchValue struct {
 	CommitID
-	Parents     []CommitID
-	isValid     bool
+	// Parents are the commits which the head of the branch is based off.
+	// These are the actual parents of the head commit, unless the merge
+	// strategy doesn't preserve the commit at which the branch was created as
+	// a direct parent, in which case that commit is used instead.
+	Parents []CommitID
+	// MergedPullRequests are the pull requests which were merged into the
+	// branch, in order, if known. The first one is the pull request which
+	// identifies the branch, any others make up a batch with it.
+	MergedPullRequests []MergedPullRequest
+	isValid            bool
+	IsCheckDone        bool
+	IsCheckPass        bool
+}
+
+// PullRequest stores the data on a pull request which determines whether it
+// can be merged.
+type PullRequest struct {
+	Number PullRequestNumber
+	// Head is the commit at the head of the pull request branch.
+	Head     CommitID
+	IsOpen   bool
+	IsLocked bool
+	IsDraft  bool
+	// IsForOtherBase is true iff the pull request targets another base branch
+	// than the one whose merge queue the GithubClient manages. The pull
+	// request is then handled by the merge queue of that other base branch.
+	// This isn't the case of stacked pull requests, see StackedOn.
+	IsForOtherBase bool
+	// StackedOn is the number of the open pull request whose head branch is
+	// the base branch of this pull request, if any. A stacked pull request
+	// gets merged into the base branch along with the one it is stacked on.
+	StackedOn PullRequestNumber
+	// HasConflicts is true iff github can't merge the pull request into its
+	// base branch.
+	HasConflicts bool
+	// IsMergeabilityPending is true iff github didn't determine in time
+	// whether the pull request has merge conflicts. In that case, only the
+	// number and possibly the head of the pull request are set.
+	IsMergeabilityPending bool
+	Labels                []string
+	// Author is the login of the author of the pull request.
+	Author string
+	// Files are the paths of the files changed by the pull request. These are
+	// only fetched when the fair share groups match paths, see FairShare.
+	Files []string
+	// Approvals is the number of reviewers whose latest review is an
+	// approval.
+	Approvals int
+	// IsChangesRequested is true iff a reviewer's latest review requests
+	// changes.
+	IsChangesRequested bool
+	// IsCheckDone and IsCheckPass reflect the status of the check suites for
+	// the head of the pull request, like for BranchValue.
 	IsCheckDone bool
 	IsCheckPass bool
 }
 
+// CanBeMerged returns true iff the pull request is open, not locked, not a
+// draft, free of merge conflicts and targets the base branch.
+func (pr PullRequest) CanBeMerged() bool {
+	return pr.IsOpen && !pr.IsLocked && !pr.IsDraft && !pr.HasConflicts && !pr.IsMergeabilityPending && !pr.IsForOtherBase
+}
+
 // GithubClient is the interface for the parts of the github API which we need.
 // Any errors will result in a panic.
 type GithubClient interface {
@@ -47,44 +208,259 @@ type GithubClient interface {
 	// DeleteBranch deletes an existing merge candidate branch.
 	DeleteBranch(bk BranchKey)
 
-	// MergeBranch attempts to merge an existing commit into an existing merge
-	// candidate branch. Returns true iff the merge succeeds.
-	MergeBranch(bk BranchKey, sha CommitID) bool
+	// MergeBranch attempts to merge the heads of pull requests, in order, into
+	// an existing merge candidate branch, using the configured merge strategy.
+	// The first pull request must be the one which identifies the branch, any
+	// others make up a batch with it.
+	// Returns Merged iff all merges succeed, otherwise the branch is left as
+	// it was.
+	MergeBranch(bk BranchKey, prs []MergedPullRequest) MergeResult
+
+	// Now returns the current time, at which the base branch may or may not be
+	// fast-forwarded depending on the merge windows.
+	Now() time.Time
 
 	// GetBaseHead returns the commit at the head to the base branch, in which
 	// all merge candidate branches are based off (directly or indirectly).
 	GetBaseHead() CommitID
 
-	// FastForwardBase fast-forwards the base branch to the specified commit.
-	FastForwardBase(sha CommitID)
+	// FastForwardBase fast-forwards the base branch to the specified commit,
+	// from the expected commit at its head: this is a compare-and-swap.
+	// Returns false if the head of the base branch isn't the expected commit,
+	// in which case it is left as it is.
+	FastForwardBase(old, sha CommitID) bool
+
+	// IsFrozen returns true iff the merge queue was frozen with SetFrozen.
+	IsFrozen() bool
 
-	// GetMergeablePullRequestHead returns the commit at the head of the pull
-	// request with the specified number, if it exists, and if it is mergeable:
-	// open, not locked, etc. Returns nil otherwise.
-	GetMergeablePullRequestHead(number PullRequestNumber) *CommitID
+	// SetFrozen freezes or unfreezes the merge queue. While it is frozen, the
+	// base branch doesn't get fast-forwarded, except through the merge
+	// candidate branches of pull requests exempt from the freeze, but merge
+	// candidate branches keep getting created and built.
+	SetFrozen(frozen bool)
+
+	// GetPullRequest returns the pull request with the specified number, if it
+	// exists. Returns nil otherwise.
+	// The data required by the configured merge rules is only fetched when
+	// needed. If github is still determining whether the pull request has
+	// merge conflicts when the context is done, the pull request is returned
+	// with IsMergeabilityPending set.
+	// This method may be called concurrently.
+	GetPullRequest(ctx context.Context, number PullRequestNumber) *PullRequest
 
 	// ListAllCommentsSince fetches all issue comments created up to a certain
-	// duration of time ago, and applies the provided function to each of their
-	// contents.
-	ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg string))
+	// duration of time ago, in chronological order, and applies the provided
+	// function to each of their contents, authors' logins and creation times.
+	// The creation time is zero if unknown.
+	ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg, author string, createdAt time.Time))
 
 	// ListAllMergeCandidateBranches fetches all branch names and applies the
 	// provided function to each merge candidate branch key.
 	ListAllMergeCandidateBranches(fn func(bk BranchKey))
+
+	// PostComment posts a comment on the pull request with the specified
+	// number.
+	PostComment(number PullRequestNumber, msg string)
+
+	// IsMaintainer returns true iff the user with the given login has the
+	// admin or maintain permission on the repo.
+	IsMaintainer(login string) bool
+
+	// GetDependencyStatus fetches the status of a pull request in another
+	// github repo, which a pull request depends on.
+	GetDependencyStatus(ref PullRequestRef) DependencyStatus
+}
+
+// BranchName returns the merge candidate branch name for this BranchKey, in
+// the merge queue of the given base branch.
+func (bk BranchKey) BranchName(base string) string {
+	return fmt.Sprintf("%s/%s/%s", MergeCandidateBranchPrefix, base, bk.TrailerValue())
 }
 
-// BranchName returns the merge candidate branch name for this BranchKey.
-func (bk BranchKey) BranchName() string {
-	return fmt.Sprintf("%s-%d-%d", MergeCandidateBranchPrefix, bk.PullRequestNumber, bk.PipelineCounter)
+// LegacyBranchName returns the merge candidate branch name for this BranchKey
+// used by earlier versions, which doesn't identify the base branch.
+func (bk BranchKey) LegacyBranchName() string {
+	return fmt.Sprintf("%s-%s", MergeCandidateBranchPrefix, bk.TrailerValue())
 }
 
-// ParseBranchKey extracts a BranchKey from a merge candidate branch name.
+// PullRequestNumbers returns the numbers of all the pull requests merged into
+// the merge candidate branch with the given key.
+func (bv BranchValue) PullRequestNumbers(bk BranchKey) []PullRequestNumber {
+	if len(bv.MergedPullRequests) == 0 {
+		return []PullRequestNumber{bk.PullRequestNumber}
+	}
+	numbers := make([]PullRequestNumber, len(bv.MergedPullRequests))
+	for i, pr := range bv.MergedPullRequests {
+		numbers[i] = pr.Number
+	}
+	return numbers
+}
+
+// Less defines the order in which merge candidate branches are processed.
+func (bk BranchKey) Less(other BranchKey) bool {
+	if bk.PullRequestNumber != other.PullRequestNumber {
+		return bk.PullRequestNumber < other.PullRequestNumber
+	}
+	return bk.PipelineCounter < other.PipelineCounter
+}
+
+// TrailerValue returns the value of the MergeCandidateTrailer for this
+// BranchKey.
+func (bk BranchKey) TrailerValue() string {
+	return fmt.Sprintf("%d-%d", bk.PullRequestNumber, bk.PipelineCounter)
+}
+
+// CandidateTrailers is the metadata recorded in the git trailers of the commit
+// at the head of a merge candidate branch.
+type CandidateTrailers struct {
+	BranchKey
+	// MergedPullRequests are the pull requests merged into the branch, see
+	// BranchValue.
+	MergedPullRequests []MergedPullRequest
+	// Onto is the commit the branch was created at. It is only recorded for
+	// merge strategies in which it is not a direct parent of the head.
+	Onto CommitID
+	// isPartial is set while the pull requests of a batch get merged, before
+	// the last one. The trailers are then left out of the commit messages, for
+	// a branch into which only part of the batch got merged not to look like
+	// a merge candidate branch.
+	isPartial bool
+}
+
+// CommitMessage returns the commit message for the head of a merge candidate
+// branch: the given text, followed by the git trailers in a paragraph of their
+// own, unless the trailers are partial.
+// The text comes from pull requests, whose authors could otherwise forge the
+// trailers: lines which look like merge candidate trailers are removed from
+// it, see StripCandidateTrailers.
+func (ct CandidateTrailers) CommitMessage(text string) string {
+	text = strings.TrimSpace(StripCandidateTrailers(text))
+	if ct.isPartial {
+		return text
+	}
+	trailers := MergeCandidateTrailer + ": " + ct.TrailerValue()
+	for i, pr := range ct.MergedPullRequests {
+		if i == 0 {
+			trailers += "\n" + MergeCandidateHeadTrailer + ": " + string(pr.Head)
+		} else {
+			trailers += fmt.Sprintf("\n%s: %d %s", MergeCandidateBatchTrailer, pr.Number, pr.Head)
+		}
+	}
+	if ct.Onto != "" {
+		trailers += "\n" + MergeCandidateOntoTrailer + ": " + string(ct.Onto)
+	}
+	if text == "" {
+		return trailers
+	}
+	return text + "\n\n" + trailers
+}
+
+// StripCandidateTrailers removes the lines which look like merge candidate
+// trailers, whatever their case, from a text which doesn't come from this
+// tool, such as the description or the commit messages of a pull request.
+func StripCandidateTrailers(text string) string {
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		key := strings.SplitN(line, ":", 2)[0]
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(key)), strings.ToLower(MergeCandidateTrailer)) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// ParseCommitMessage extracts the CandidateTrailers from the commit message at
+// the head of a merge candidate branch. These must make up its last paragraph,
+// which begins with the MergeCandidateTrailer, as written by CommitMessage.
+// Commit messages consisting only of the branch name are also accepted, for
+// compatibility with merge candidate branches created by earlier versions.
+func ParseCommitMessage(msg string) (ct CandidateTrailers, isValid bool) {
+	msg = strings.TrimSpace(msg)
+	if _, bk, isLegacy, _ := ParseBranchName(msg); isLegacy {
+		ct.BranchKey = bk
+		return ct, true
+	}
+	var head CommitID
+	var batch []MergedPullRequest
+	paragraphs := strings.Split(msg, "\n\n")
+	for i, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || (i == 0) != (parts[0] == MergeCandidateTrailer) {
+			return CandidateTrailers{}, false
+		}
+		value := strings.TrimSpace(parts[1])
+		switch parts[0] {
+		case MergeCandidateTrailer:
+			if isValid {
+				// Duplicate trailer.
+				return CandidateTrailers{}, false
+			}
+			ct.BranchKey, isValid = parseTrailerValue(value)
+			if !isValid {
+				return CandidateTrailers{}, false
+			}
+		case MergeCandidateHeadTrailer:
+			head = CommitID(value)
+		case MergeCandidateBatchTrailer:
+			fields := strings.Fields(value)
+			if len(fields) != 2 {
+				return CandidateTrailers{}, false
+			}
+			num, err := strconv.Atoi(fields[0])
+			if err != nil || num <= 0 {
+				return CandidateTrailers{}, false
+			}
+			batch = append(batch, MergedPullRequest{Number: PullRequestNumber(num), Head: CommitID(fields[1])})
+		case MergeCandidateOntoTrailer:
+			ct.Onto = CommitID(value)
+		default:
+			return CandidateTrailers{}, false
+		}
+	}
+	if !isValid || (head == "" && len(batch) > 0) {
+		return CandidateTrailers{}, false
+	}
+	if head != "" {
+		ct.MergedPullRequests = append([]MergedPullRequest{{Number: ct.PullRequestNumber, Head: head}}, batch...)
+	}
+	return ct, true
+}
+
+// ParseBranchKey extracts a BranchKey from a merge candidate branch name, of
+// any base branch. Legacy branch names are also accepted, see ParseBranchName.
 func ParseBranchKey(branchName string) (bk BranchKey, isValid bool) {
-	if !strings.HasPrefix(branchName, MergeCandidateBranchPrefix+"-") {
-		return bk, false
+	_, bk, _, isValid = ParseBranchName(branchName)
+	return bk, isValid
+}
+
+// ParseBranchName extracts the base branch and the BranchKey from a merge
+// candidate branch name. Branch names without base branch, as named by earlier
+// versions, are also accepted, in which case isLegacy is set and base is empty.
+func ParseBranchName(branchName string) (base string, bk BranchKey, isLegacy, isValid bool) {
+	if strings.HasPrefix(branchName, MergeCandidateBranchPrefix+"-") {
+		bk, isValid = parseTrailerValue(branchName[len(MergeCandidateBranchPrefix+"-"):])
+		return "", bk, isValid, isValid
+	}
+	if !strings.HasPrefix(branchName, MergeCandidateBranchPrefix+"/") {
+		return "", bk, false, false
 	}
-	suffix := branchName[len(MergeCandidateBranchPrefix+"-"):]
-	parts := strings.Split(suffix, "-")
+	suffix := branchName[len(MergeCandidateBranchPrefix+"/"):]
+	i := strings.LastIndex(suffix, "/")
+	if i <= 0 {
+		return "", bk, false, false
+	}
+	bk, isValid = parseTrailerValue(suffix[i+1:])
+	if !isValid {
+		return "", bk, false, false
+	}
+	return suffix[:i], bk, false, true
+}
+
+// parseTrailerValue extracts a BranchKey from the value of a
+// MergeCandidateTrailer.
+func parseTrailerValue(value string) (bk BranchKey, isValid bool) {
+	parts := strings.Split(value, "-")
 	if len(parts) != 2 {
 		return bk, false
 	}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// TestCommitMessage checks that the merge candidate git trailers survive a
+// round trip through the commit message of the head of a branch.
+func TestCommitMessage(t *testing.T) {
+	bk := BranchKey{PullRequestNumber: 123, PipelineCounter: 4}
+	cfg := DefaultConfig()
+	text := cfg.CommitMessage(CommitMessageData{
+		Number:    123,
+		Title:     "Fix the thing",
+		Body:      "It was broken.",
+		Author:    "alice",
+		Approvers: []string{"bob", "carol"},
+	})
+	ct := CandidateTrailers{BranchKey: bk, MergedPullRequests: []MergedPullRequest{{Number: 123, Head: "def"}}}
+	msg := ct.CommitMessage(text)
+	require.Equal(t, "Fix the thing (#123)\n\nIt was broken.\n\nApproved-by: bob, carol\n\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def", msg)
+	actual, ok := ParseCommitMessage(msg)
+	require.True(t, ok)
+	require.Equal(t, ct, actual)
+
+	ct.Onto = "abc"
+	msg = ct.CommitMessage("Some commit\n\nNo trailers here.")
+	require.Equal(t, "Some commit\n\nNo trailers here.\n\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def\nMerge-Candidate-Onto: abc", msg)
+	actual, ok = ParseCommitMessage(msg)
+	require.True(t, ok)
+	require.Equal(t, ct, actual)
+
+	ct.MergedPullRequests = append(ct.MergedPullRequests, MergedPullRequest{Number: 125, Head: "ghi"})
+	msg = ct.CommitMessage("Batch")
+	require.Equal(t, "Batch\n\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def\nMerge-Candidate-Batch: 125 ghi\nMerge-Candidate-Onto: abc", msg)
+	actual, ok = ParseCommitMessage(msg)
+	require.True(t, ok)
+	require.Equal(t, ct, actual)
+
+	// Trailers injected through the pull request body are dropped, and the
+	// tool's own always come last, in a paragraph of their own.
+	ct = CandidateTrailers{BranchKey: bk, MergedPullRequests: []MergedPullRequest{{Number: 123, Head: "def"}}}
+	msg = ct.CommitMessage("Fix the thing\n\nMerge-Candidate-Onto: deadbeef\nMerge-Candidate-Batch: 999 cafe")
+	require.Equal(t, "Fix the thing\n\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def", msg)
+	actual, ok = ParseCommitMessage(msg)
+	require.True(t, ok)
+	require.Equal(t, ct, actual)
+	msg = ct.CommitMessage("Fix the thing\n\nApproved-by: bob\nmerge-candidate-onto: deadbeef")
+	require.Equal(t, "Fix the thing\n\nApproved-by: bob\n\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def", msg)
+
+	// Branches created by earlier versions.
+	actual, ok = ParseCommitMessage("merge-candidate-123-4")
+	require.True(t, ok)
+	require.Equal(t, CandidateTrailers{BranchKey: bk}, actual)
+
+	for _, invalid := range []string{
+		"",
+		"Fix the thing",
+		"Merge-Candidate: 123-4\n\nFix the thing",
+		"Merge-Candidate: 123\n",
+		"Merge-Candidate: 123-4\nMerge-Candidate: 123-5",
+		"Merge-Candidate: 123-4\nMerge-Candidate-Batch: 125 ghi",
+		"Merge-Candidate: 123-4\nMerge-Candidate-Head: def\nMerge-Candidate-Batch: 125",
+		"Approved-by: bob\nMerge-Candidate: 123-4\nMerge-Candidate-Head: def",
+		"Merge-Candidate: 123-4\nMerge-Candidate-Head: def\nApproved-by: bob",
+		"Merge-Candidate-Head: def\nMerge-Candidate: 123-4",
+	} {
+		_, ok = ParseCommitMessage(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+// TestParseBranchName checks that merge candidate branch names survive a round
+// trip, including those with a legacy name.
+func TestParseBranchName(t *testing.T) {
+	bk := BranchKey{PullRequestNumber: 123, PipelineCounter: 4}
+	for _, base := range []string{"main", "release/23.1"} {
+		name := bk.BranchName(base)
+		actualBase, actual, isLegacy, ok := ParseBranchName(name)
+		require.True(t, ok, name)
+		require.False(t, isLegacy, name)
+		require.Equal(t, base, actualBase)
+		require.Equal(t, bk, actual)
+	}
+	require.Equal(t, "merge-candidate/release/23.1/123-4", bk.BranchName("release/23.1"))
+
+	require.Equal(t, "merge-candidate-123-4", bk.LegacyBranchName())
+	base, actual, isLegacy, ok := ParseBranchName(bk.LegacyBranchName())
+	require.True(t, ok)
+	require.True(t, isLegacy)
+	require.Empty(t, base)
+	require.Equal(t, bk, actual)
+
+	for _, invalid := range []string{
+		"",
+		"main",
+		"merge-candidate",
+		"merge-candidate-123",
+		"merge-candidate/123-4",
+		"merge-candidate//123-4",
+		"merge-candidate/main/123",
+		"merge-candidate/main/0-1",
+	} {
+		_, _, _, ok = ParseBranchName(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+func TestParsePullRequestRef(t *testing.T) {
+	ref, ok := ParsePullRequestRef("org/repo#123")
+	require.True(t, ok)
+	require.Equal(t, PullRequestRef{Repo: "org/repo", Number: 123}, ref)
+	require.Equal(t, "org/repo#123", ref.String())
+	ref, ok = ParsePullRequestRef("#123")
+	require.True(t, ok)
+	require.Equal(t, PullRequestRef{Number: 123}, ref)
+	require.Equal(t, "#123", ref.String())
+	for _, invalid := range []string{"", "#", "repo#123", "org/repo", "org/repo#", "org/repo#0", "org/repo#12#3", "/repo#1"} {
+		_, ok = ParsePullRequestRef(invalid)
+		require.False(t, ok, invalid)
+	}
+}
+
+// TestFairShareGroup checks how pull requests are matched against the fair
+// share groups, including CODEOWNERS patterns.
+func TestFairShareGroup(t *testing.T) {
+	fs := FairShare{Groups: []FairShareGroup{
+		{Name: "infra", Labels: []string{"team-infra"}, Authors: []string{"alice"}},
+		{Name: "docs", Paths: []string{"/docs/", "*.md"}},
+		{Name: "web", Paths: []string{"web/**/*.js", "ui/?.css"}},
+	}}
+	for _, tc := range []struct {
+		pr    PullRequest
+		group string
+	}{
+		{PullRequest{Labels: []string{"lgtm", "team-infra"}}, "infra"},
+		{PullRequest{Author: "alice", Files: []string{"docs/guide.md"}}, "infra"},
+		{PullRequest{Files: []string{"main.go", "docs/img/logo.png"}}, "docs"},
+		{PullRequest{Files: []string{"src/docs/x.go"}}, ""},
+		{PullRequest{Files: []string{"src/README.md"}}, "docs"},
+		{PullRequest{Files: []string{"web/app.js"}}, "web"},
+		{PullRequest{Files: []string{"web/a/b/app.js"}}, "web"},
+		{PullRequest{Files: []string{"src/web/app.js"}}, ""},
+		{PullRequest{Files: []string{"ui/a.css"}}, "web"},
+		{PullRequest{Files: []string{"ui/ab.css"}}, ""},
+		{PullRequest{Author: "bob"}, ""},
+	} {
+		require.Equal(t, tc.group, fs.Group(tc.pr), "%+v", tc.pr)
+	}
+
+	fs.Groups = append(fs.Groups, FairShareGroup{Name: "others"})
+	require.Equal(t, "others", fs.Group(PullRequest{Author: "bob"}))
+}
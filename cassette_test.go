@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var record = flag.Bool("record", false, "record the github API cassettes against the repo "+
+	"in $GITHUB_OWNER/$GITHUB_REPO with the token in $GITHUB_TOKEN, instead of replaying them")
+
+const cassetteDir = testDataDir + "/cassettes"
+
+// cassetteOwner and cassetteRepo replace the actual owner and repo in recorded
+// cassettes.
+const cassetteOwner = "owner"
+const cassetteRepo = "repo"
+
+// githubAPIURL is the github API which cassettes are recorded against.
+const githubAPIURL = "https://api.github.com"
+
+// volatileQueryParams are ignored when matching a request to a recorded one,
+// because they change every time.
+var volatileQueryParams = []string{"since"}
+
+// recordedHeaders are the response headers which are recorded.
+var recordedHeaders = []string{"Content-Type", "Link"}
+
+// Interaction is a recorded github API request and its response.
+type Interaction struct {
+	Request  RecordedRequest  `yaml:"request"`
+	Response RecordedResponse `yaml:"response"`
+}
+
+// RecordedRequest is a github API request in a cassette.
+type RecordedRequest struct {
+	Method string `yaml:"method"`
+	// URL is the path and query of the request.
+	URL  string `yaml:"url"`
+	Body string `yaml:"body,omitempty"`
+}
+
+// RecordedResponse is a github API response in a cassette.
+type RecordedResponse struct {
+	Status  int               `yaml:"status"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+	Body    string            `yaml:"body,omitempty"`
+}
+
+// cassette serves the github API by replaying a sequence of recorded
+// interactions in order, or records them by forwarding the requests to the
+// actual github API.
+type cassette struct {
+	t            *testing.T
+	path         string
+	owner, repo  string
+	mu           sync.Mutex
+	interactions []Interaction
+	numReplayed  int
+}
+
+// newCassetteClient returns a githubClientImpl which talks to a cassette
+// server, in either replay or record mode. The cassette is checked to have been
+// replayed entirely, or is written, when the test is done.
+func newCassetteClient(t *testing.T, name string, cfg Config) *githubClientImpl {
+	cs := &cassette{
+		t:     t,
+		path:  cassetteDir + "/" + name + ".yaml",
+		owner: cassetteOwner,
+		repo:  cassetteRepo,
+	}
+	if *record {
+		cs.owner, cs.repo = os.Getenv("GITHUB_OWNER"), os.Getenv("GITHUB_REPO")
+		require.NotEmpty(t, cs.owner, "GITHUB_OWNER")
+		require.NotEmpty(t, cs.repo, "GITHUB_REPO")
+		require.NotEmpty(t, os.Getenv("GITHUB_TOKEN"), "GITHUB_TOKEN")
+	} else {
+		data, err := ioutil.ReadFile(cs.path)
+		require.NoError(t, err)
+		require.NoError(t, yaml.Unmarshal(data, &cs.interactions))
+	}
+	server := httptest.NewServer(cs)
+	t.Cleanup(func() {
+		server.Close()
+		cs.finish()
+	})
+	baseURL, err := url.Parse(server.URL + "/")
+	require.NoError(t, err)
+	c := newGithubClientImpl(server.Client(), baseURL, cs.owner, cs.repo, "main", cfg)
+	c.pollInterval = 0
+	return c
+}
+
+func (cs *cassette) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := RecordedRequest{
+		Method: r.Method,
+		URL:    cs.anonymize(r.URL.RequestURI()),
+		Body:   cs.anonymize(string(body)),
+	}
+	var resp RecordedResponse
+	if *record {
+		resp, err = cs.forward(r.Method, r.URL.RequestURI(), body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		cs.interactions = append(cs.interactions, Interaction{Request: req, Response: resp})
+		resp.Body = cs.deanonymize(resp.Body)
+	} else {
+		if cs.numReplayed >= len(cs.interactions) {
+			cs.t.Errorf("unexpected request %s %s", req.Method, req.URL)
+			http.Error(w, "unexpected request", http.StatusInternalServerError)
+			return
+		}
+		expected := cs.interactions[cs.numReplayed]
+		cs.numReplayed++
+		if !requestsMatch(expected.Request, req) {
+			cs.t.Errorf("request #%d is %s %s %s, expected %s %s %s", cs.numReplayed,
+				req.Method, req.URL, req.Body,
+				expected.Request.Method, expected.Request.URL, expected.Request.Body)
+			http.Error(w, "unexpected request", http.StatusInternalServerError)
+			return
+		}
+		resp = expected.Response
+	}
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(resp.Status)
+	_, _ = w.Write([]byte(resp.Body))
+}
+
+// forward makes a request to the actual github API.
+func (cs *cassette) forward(method, uri string, body []byte) (RecordedResponse, error) {
+	req, err := http.NewRequest(method, githubAPIURL+uri, bytes.NewReader(body))
+	if err != nil {
+		return RecordedResponse{}, err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "token "+os.Getenv("GITHUB_TOKEN"))
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return RecordedResponse{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return RecordedResponse{}, err
+	}
+	ret := RecordedResponse{Status: resp.StatusCode, Body: cs.anonymize(string(respBody))}
+	for _, k := range recordedHeaders {
+		if v := resp.Header.Get(k); v != "" {
+			if ret.Headers == nil {
+				ret.Headers = map[string]string{}
+			}
+			ret.Headers[k] = cs.anonymize(v)
+		}
+	}
+	return ret, nil
+}
+
+// finish writes the cassette in record mode, otherwise it checks that all its
+// interactions have been replayed.
+func (cs *cassette) finish() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if *record {
+		data, err := yaml.Marshal(cs.interactions)
+		require.NoError(cs.t, err)
+		require.NoError(cs.t, os.MkdirAll(cassetteDir, 0755))
+		require.NoError(cs.t, ioutil.WriteFile(cs.path, data, 0644))
+		return
+	}
+	if cs.numReplayed < len(cs.interactions) {
+		next := cs.interactions[cs.numReplayed].Request
+		cs.t.Errorf("%d interaction(s) not replayed, starting with %s %s",
+			len(cs.interactions)-cs.numReplayed, next.Method, next.URL)
+	}
+}
+
+func (cs *cassette) anonymize(s string) string {
+	return strings.Replace(s, cs.owner+"/"+cs.repo, cassetteOwner+"/"+cassetteRepo, -1)
+}
+
+func (cs *cassette) deanonymize(s string) string {
+	return strings.Replace(s, cassetteOwner+"/"+cassetteRepo, cs.owner+"/"+cs.repo, -1)
+}
+
+// requestsMatch returns true iff the requests have the same method, path,
+// non-volatile query parameters and JSON body.
+func requestsMatch(expected, actual RecordedRequest) bool {
+	if expected.Method != actual.Method {
+		return false
+	}
+	eu, err := url.Parse(expected.URL)
+	if err != nil {
+		return false
+	}
+	au, err := url.Parse(actual.URL)
+	if err != nil || eu.Path != au.Path {
+		return false
+	}
+	eq, aq := eu.Query(), au.Query()
+	for _, k := range volatileQueryParams {
+		eq.Del(k)
+		aq.Del(k)
+	}
+	if !reflect.DeepEqual(eq, aq) {
+		return false
+	}
+	if strings.TrimSpace(expected.Body) == "" || strings.TrimSpace(actual.Body) == "" {
+		return strings.TrimSpace(expected.Body) == strings.TrimSpace(actual.Body)
+	}
+	var eb, ab interface{}
+	if json.Unmarshal([]byte(expected.Body), &eb) != nil || json.Unmarshal([]byte(actual.Body), &ab) != nil {
+		return expected.Body == actual.Body
+	}
+	return reflect.DeepEqual(eb, ab)
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MergeStrategy determines how the head of a pull request gets merged into a
+// merge candidate branch, and therefore what ends up in the base branch once
+// it gets fast-forwarded.
+type MergeStrategy string
+
+const (
+	// MergeCommitStrategy creates a two-parent merge commit on top of the
+	// merge candidate branch.
+	MergeCommitStrategy MergeStrategy = "merge"
+	// SquashStrategy creates one single-parent commit per pull request, with
+	// the same contents as the merge commit would have.
+	SquashStrategy MergeStrategy = "squash"
+	// RebaseStrategy replays the commits of the pull request on top of the
+	// merge candidate branch.
+	RebaseStrategy MergeStrategy = "rebase"
+)
+
+// PipelineStrategyName selects a PipelineStrategy.
+type PipelineStrategyName string
+
+const (
+	// PipelineStrategyPipeline creates one merge candidate branch per pull
+	// request and per commit in the build pipeline.
+	PipelineStrategyPipeline PipelineStrategyName = "pipeline"
+	// PipelineStrategyBatch merges batches of pull requests into a single
+	// merge candidate branch, one batch at a time, like bors does.
+	PipelineStrategyBatch PipelineStrategyName = "batch"
+	// PipelineStrategyHybrid pipelines batches of pull requests.
+	PipelineStrategyHybrid PipelineStrategyName = "hybrid"
+)
+
+// DefaultCommitMessageTemplate is the default value of
+// Config.CommitMessageTemplate.
+const DefaultCommitMessageTemplate = `{{.Title}} (#{{.Number}})
+
+{{.Body}}
+{{if .Approvers}}
+Approved-by: {{join .Approvers ", "}}
+{{end}}`
+
+// CommitMessageData is the data available to Config.CommitMessageTemplate.
+type CommitMessageData struct {
+	// Number is the pull request number.
+	Number PullRequestNumber
+	// Title is the pull request title.
+	Title string
+	// Body is the pull request description.
+	Body string
+	// Author is the login of the pull request author.
+	Author string
+	// Approvers are the logins of the users whose latest review of the pull
+	// request is an approval, sorted alphabetically.
+	Approvers []string
+}
+
+// Config holds the per-repository settings.
+type Config struct {
+	// MergeStrategy defines how pull requests are merged into merge candidate
+	// branches. Defaults to MergeCommitStrategy.
+	MergeStrategy MergeStrategy `yaml:"merge_strategy,omitempty"`
+	// CommitMessageTemplate is a text/template which renders the message of
+	// the commits created by the merge commit and squash strategies, given a
+	// CommitMessageData. The rebase strategy preserves the commit messages of
+	// the pull request.
+	// The git trailers which identify merge candidate branches are appended
+	// to the rendered message.
+	CommitMessageTemplate string `yaml:"commit_message_template,omitempty"`
+	// RequeueOnPush determines what happens when the head of a pull request
+	// changes after it was approved: if set, the pull request is merged with
+	// its new head, otherwise it needs to be approved again.
+	RequeueOnPush bool `yaml:"requeue_on_push,omitempty"`
+	// PipelineStrategy selects the strategy for creating merge candidate
+	// branches. Defaults to PipelineStrategyPipeline.
+	PipelineStrategy PipelineStrategyName `yaml:"pipeline_strategy,omitempty"`
+	// MaxBatchSize is the maximum number of pull requests in a batch, for the
+	// strategies which batch pull requests.
+	MaxBatchSize int `yaml:"max_batch_size,omitempty"`
+	// MergeRules are the conditions which pull requests need to satisfy to be
+	// merged.
+	MergeRules MergeRules `yaml:"merge_rules,omitempty"`
+	// MergeabilityTimeout is how long to wait for github to determine whether
+	// pull requests have merge conflicts, after which the undetermined ones
+	// are skipped until the next pass.
+	MergeabilityTimeout time.Duration `yaml:"mergeability_timeout,omitempty"`
+	// MaxConcurrentRequests bounds the number of concurrent github API calls
+	// when fetching pull requests.
+	MaxConcurrentRequests int `yaml:"max_concurrent_requests,omitempty"`
+	// FairShare shares the build pipeline between groups of pull requests,
+	// so that a burst of pull requests from one group doesn't hold up the
+	// others. Pull requests are queued in order of their numbers unless
+	// groups are configured.
+	FairShare FairShare `yaml:"fair_share,omitempty"`
+	// MergeWindows are cron-style schedules of the times at which the base
+	// branch may be fast-forwarded, see cronSchedule. The base branch is
+	// frozen outside of them, and at no time if there are none.
+	MergeWindows []string `yaml:"merge_windows,omitempty"`
+	// MergeWindowTimeZone is the name of the time zone of the merge windows,
+	// such as "Europe/Paris". Defaults to UTC.
+	MergeWindowTimeZone string `yaml:"merge_window_time_zone,omitempty"`
+	// FreezeExemptLabels are labels of pull requests which get merged even
+	// while the base branch is frozen, such as "release-blocker".
+	FreezeExemptLabels []string `yaml:"freeze_exempt_labels,omitempty"`
+}
+
+// FairShare is the configuration of the fair-share queueing of pull requests.
+// The next pull request for which merge candidate branches are created is
+// picked from the group with the fewest pull requests in the build pipeline,
+// which amounts to picking from each group in turn.
+type FairShare struct {
+	// Groups are matched against pull requests in order, a pull request
+	// belongs to the first group it matches. Those which match none form a
+	// group of their own.
+	Groups []FairShareGroup `yaml:"groups,omitempty"`
+}
+
+// FairShareGroup is a group of pull requests, typically those of a team or of
+// an area of the code base. A pull request matches the group if it has one of
+// its labels, if its author is one of its authors, or if it changes a file
+// matching one of its paths. A group with none of these matches any pull
+// request.
+type FairShareGroup struct {
+	// Name identifies the group.
+	Name string `yaml:"name"`
+	// Labels are labels which pull requests of the group have.
+	Labels []string `yaml:"labels,omitempty"`
+	// Authors are the logins of the members of the team, whose pull requests
+	// are in the group.
+	Authors []string `yaml:"authors,omitempty"`
+	// Paths are patterns with the syntax of CODEOWNERS files, which the files
+	// changed by pull requests of the group match.
+	Paths []string `yaml:"paths,omitempty"`
+	// MaxSpeculativeBranches bounds the number of merge candidate branches
+	// created off of commits in the build pipeline for each pull request of
+	// the group, on top of the one off of the base branch. Those closest to
+	// the head of the build pipeline are preferred. Zero means no limit.
+	MaxSpeculativeBranches int `yaml:"max_speculative_branches,omitempty"`
+}
+
+// Group returns the name of the group of the pull request, or an empty string
+// if it belongs to none.
+func (fs FairShare) Group(pr PullRequest) string {
+	for _, g := range fs.Groups {
+		if g.matches(pr) {
+			return g.Name
+		}
+	}
+	return ""
+}
+
+// MaxSpeculativeBranches returns the limit on the number of speculative merge
+// candidate branches for the pull requests of a group, 0 if there is none.
+func (fs FairShare) MaxSpeculativeBranches(group string) int {
+	for _, g := range fs.Groups {
+		if g.Name == group {
+			return g.MaxSpeculativeBranches
+		}
+	}
+	return 0
+}
+
+// usesPaths returns true iff a group needs the files changed by pull requests
+// to be matched.
+func (fs FairShare) usesPaths() bool {
+	for _, g := range fs.Groups {
+		if len(g.Paths) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g FairShareGroup) matches(pr PullRequest) bool {
+	if len(g.Labels) == 0 && len(g.Authors) == 0 && len(g.Paths) == 0 {
+		return true
+	}
+	for _, label := range pr.Labels {
+		for _, l := range g.Labels {
+			if label == l {
+				return true
+			}
+		}
+	}
+	for _, author := range g.Authors {
+		if pr.Author == author {
+			return true
+		}
+	}
+	for _, pattern := range g.Paths {
+		re := codeownersPatternRegexp(pattern)
+		for _, file := range pr.Files {
+			if re.MatchString(file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// codeownersPatternRegexp returns a regexp matching the paths matched by a
+// CODEOWNERS pattern. As in gitignore files, a pattern which contains a slash
+// other than a trailing one is relative to the root of the repo, otherwise it
+// matches at any depth, "*" and "?" don't match slashes but "**" does, and a
+// pattern matching a directory matches all the files under it.
+func codeownersPatternRegexp(pattern string) *regexp.Regexp {
+	p := strings.TrimSuffix(pattern, "/")
+	prefix := "^(.*/)?"
+	if strings.Contains(p, "/") {
+		prefix = "^"
+	}
+	p = strings.TrimPrefix(p, "/")
+	var b strings.Builder
+	b.WriteString(prefix)
+	for i := 0; i < len(p); i++ {
+		switch {
+		case strings.HasPrefix(p[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(p[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case p[i] == '*':
+			b.WriteString("[^/]*")
+		case p[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		}
+	}
+	b.WriteString("(/.*)?$")
+	return regexp.MustCompile(b.String())
+}
+
+// MergeRules are the configurable conditions which a pull request needs to
+// satisfy to be merged, on top of being open, unlocked, not a draft and free
+// of merge conflicts.
+type MergeRules struct {
+	// RequiredApprovals is the minimum number of approving reviews.
+	RequiredApprovals int `yaml:"required_approvals,omitempty"`
+	// BlockOnChangesRequested blocks pull requests which have reviews
+	// requesting changes.
+	BlockOnChangesRequested bool `yaml:"block_on_changes_requested,omitempty"`
+	// BlockingLabels are labels which block pull requests.
+	BlockingLabels []string `yaml:"blocking_labels,omitempty"`
+	// RequiredLabels are labels which pull requests must all have.
+	RequiredLabels []string `yaml:"required_labels,omitempty"`
+	// RequirePassingChecks blocks pull requests whose own check suites haven't
+	// all passed.
+	RequirePassingChecks bool `yaml:"require_passing_checks,omitempty"`
+}
+
+// Check returns the first rule blocking the pull request from being merged
+// along with a human-readable reason, or empty strings if none does.
+func (r MergeRules) Check(pr PullRequest) (rule, reason string) {
+	if pr.Approvals < r.RequiredApprovals {
+		return "required_approvals", fmt.Sprintf(
+			"it has %d approving review(s) but %d are required", pr.Approvals, r.RequiredApprovals)
+	}
+	if r.BlockOnChangesRequested && pr.IsChangesRequested {
+		return "block_on_changes_requested", "changes have been requested by a reviewer"
+	}
+	labels := make(map[string]struct{}, len(pr.Labels))
+	for _, label := range pr.Labels {
+		labels[label] = struct{}{}
+	}
+	for _, label := range r.BlockingLabels {
+		if _, ok := labels[label]; ok {
+			return "blocking_labels", fmt.Sprintf("it has the %q label", label)
+		}
+	}
+	for _, label := range r.RequiredLabels {
+		if _, ok := labels[label]; !ok {
+			return "required_labels", fmt.Sprintf("it doesn't have the %q label", label)
+		}
+	}
+	if r.RequirePassingChecks && !(pr.IsCheckDone && pr.IsCheckPass) {
+		return "require_passing_checks", "its checks haven't passed"
+	}
+	return "", ""
+}
+
+// DefaultConfig returns the configuration used when none is provided.
+func DefaultConfig() Config {
+	return Config{
+		MergeStrategy:         MergeCommitStrategy,
+		CommitMessageTemplate: DefaultCommitMessageTemplate,
+		PipelineStrategy:      PipelineStrategyPipeline,
+		MaxBatchSize:          8,
+		MergeabilityTimeout:   30 * time.Second,
+		MaxConcurrentRequests: 8,
+	}
+}
+
+// ReadConfig reads a yaml configuration file, any settings missing from it
+// take their default values.
+// Any errors will result in a panic.
+func ReadConfig(path string) Config {
+	data, err := ioutil.ReadFile(path)
+	onErrPanic(err)
+	cfg := DefaultConfig()
+	onErrPanic(yaml.UnmarshalStrict(data, &cfg))
+	onErrPanic(cfg.Validate())
+	return cfg
+}
+
+// Validate returns an error if the configuration is invalid.
+func (cfg Config) Validate() error {
+	switch cfg.MergeStrategy {
+	case MergeCommitStrategy, SquashStrategy, RebaseStrategy:
+	default:
+		return fmt.Errorf("unknown merge strategy %q", cfg.MergeStrategy)
+	}
+	switch cfg.PipelineStrategy {
+	case PipelineStrategyPipeline, PipelineStrategyBatch, PipelineStrategyHybrid:
+	default:
+		return fmt.Errorf("unknown pipeline strategy %q", cfg.PipelineStrategy)
+	}
+	if cfg.MaxBatchSize <= 0 {
+		return fmt.Errorf("non-positive max batch size %d", cfg.MaxBatchSize)
+	}
+	if cfg.MergeRules.RequiredApprovals < 0 {
+		return fmt.Errorf("negative number of required approvals %d", cfg.MergeRules.RequiredApprovals)
+	}
+	if cfg.MergeabilityTimeout <= 0 {
+		return fmt.Errorf("non-positive mergeability timeout %s", cfg.MergeabilityTimeout)
+	}
+	if cfg.MaxConcurrentRequests <= 0 {
+		return fmt.Errorf("non-positive max concurrent requests %d", cfg.MaxConcurrentRequests)
+	}
+	names := map[string]bool{}
+	for _, g := range cfg.FairShare.Groups {
+		if g.Name == "" || names[g.Name] {
+			return fmt.Errorf("empty or duplicate fair share group name %q", g.Name)
+		}
+		names[g.Name] = true
+		if g.MaxSpeculativeBranches < 0 {
+			return fmt.Errorf("negative max speculative branches %d for fair share group %q", g.MaxSpeculativeBranches, g.Name)
+		}
+	}
+	for _, spec := range cfg.MergeWindows {
+		if _, err := parseCronSchedule(spec); err != nil {
+			return fmt.Errorf("invalid merge window: %v", err)
+		}
+	}
+	if _, err := time.LoadLocation(cfg.MergeWindowTimeZone); err != nil {
+		return fmt.Errorf("invalid merge window time zone: %v", err)
+	}
+	if _, err := cfg.commitMessageTemplate(); err != nil {
+		return fmt.Errorf("invalid commit message template: %v", err)
+	}
+	return nil
+}
+
+// IsInMergeWindow returns true iff the base branch may be fast-forwarded at
+// the given time, according to the merge windows.
+// Any errors will result in a panic.
+func (cfg Config) IsInMergeWindow(now time.Time) bool {
+	if len(cfg.MergeWindows) == 0 {
+		return true
+	}
+	loc, err := time.LoadLocation(cfg.MergeWindowTimeZone)
+	onErrPanic(err)
+	for _, spec := range cfg.MergeWindows {
+		s, err := parseCronSchedule(spec)
+		onErrPanic(err)
+		if s.Matches(now.In(loc)) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommitMessage renders the commit message template.
+// Any errors will result in a panic.
+func (cfg Config) CommitMessage(data CommitMessageData) string {
+	tmpl, err := cfg.commitMessageTemplate()
+	onErrPanic(err)
+	var buf bytes.Buffer
+	onErrPanic(tmpl.Execute(&buf, data))
+	return buf.String()
+}
+
+func (cfg Config) commitMessageTemplate() (*template.Template, error) {
+	return template.New("commit_message").
+		Funcs(template.FuncMap{"join": strings.Join}).
+		Parse(cfg.CommitMessageTemplate)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DaemonConfig is the configuration of a daemon which manages the merge queues
+// of several base branches, in one or more github repos.
+type DaemonConfig struct {
+	// PollInterval is the time between runs of the state machine of each
+	// merge queue. Defaults to one minute.
+	PollInterval time.Duration `yaml:"poll_interval,omitempty"`
+	// CommentLookback is how long ago the comments on pull requests are
+	// fetched from. Defaults to one week.
+	CommentLookback time.Duration `yaml:"comment_lookback,omitempty"`
+	// MetricsAddr is the address on which the metrics are served, if any.
+	MetricsAddr string `yaml:"metrics_addr,omitempty"`
+	// Queues are the merge queues managed by the daemon.
+	Queues []QueueConfig `yaml:"queues"`
+}
+
+// QueueConfig identifies the merge queue of a base branch in a github repo.
+type QueueConfig struct {
+	// Repo is the github repo, as "owner/repo".
+	Repo string `yaml:"repo"`
+	// Base is the base branch.
+	Base string `yaml:"base"`
+	// ConfigPath is the path to the configuration file of the merge queue,
+	// relative to the daemon configuration file. The default configuration is
+	// used if empty.
+	ConfigPath string `yaml:"config,omitempty"`
+	// Config is the configuration of the merge queue, read from ConfigPath.
+	Config Config `yaml:"-"`
+}
+
+// ReadDaemonConfig reads a yaml daemon configuration file, and the
+// configuration files of the merge queues.
+// Any errors will result in a panic.
+func ReadDaemonConfig(path string) DaemonConfig {
+	data, err := ioutil.ReadFile(path)
+	onErrPanic(err)
+	dc := DaemonConfig{
+		PollInterval:    time.Minute,
+		CommentLookback: 7 * 24 * time.Hour,
+	}
+	onErrPanic(yaml.UnmarshalStrict(data, &dc))
+	for i, qc := range dc.Queues {
+		dc.Queues[i].Config = DefaultConfig()
+		if qc.ConfigPath != "" {
+			dc.Queues[i].Config = ReadConfig(filepath.Join(filepath.Dir(path), qc.ConfigPath))
+		}
+	}
+	onErrPanic(dc.Validate())
+	return dc
+}
+
+// Validate returns an error if the daemon configuration is invalid.
+func (dc DaemonConfig) Validate() error {
+	if dc.PollInterval <= 0 {
+		return fmt.Errorf("non-positive poll interval %s", dc.PollInterval)
+	}
+	if dc.CommentLookback <= 0 {
+		return fmt.Errorf("non-positive comment lookback %s", dc.CommentLookback)
+	}
+	if len(dc.Queues) == 0 {
+		return fmt.Errorf("no queues")
+	}
+	queues := map[[2]string]struct{}{}
+	for _, qc := range dc.Queues {
+		if _, _, ok := qc.ownerAndRepo(); !ok {
+			return fmt.Errorf("invalid repo %q, expected owner/repo", qc.Repo)
+		}
+		if qc.Base == "" {
+			return fmt.Errorf("no base branch for repo %s", qc.Repo)
+		}
+		key := [2]string{qc.Repo, qc.Base}
+		if _, found := queues[key]; found {
+			return fmt.Errorf("duplicate queue for %s:%s", qc.Repo, qc.Base)
+		}
+		queues[key] = struct{}{}
+		if err := qc.Config.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration for %s:%s: %v", qc.Repo, qc.Base, err)
+		}
+	}
+	return nil
+}
+
+func (qc QueueConfig) ownerAndRepo() (owner, repo string, ok bool) {
+	parts := strings.Split(qc.Repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// Daemon manages the merge queues of several base branches by running their
+// state machines in turn, at a regular interval. The github clients of the
+// queues share the same HTTP client, and therefore the same rate limit.
+type Daemon struct {
+	cfg    DaemonConfig
+	queues []daemonQueue
+}
+
+type daemonQueue struct {
+	QueueConfig
+	client GithubClient
+	log    *Logger
+}
+
+// NewDaemon returns a Daemon which manages the merge queues in the given
+// configuration, using the github API at apiURL, or the default one if empty,
+// with the given HTTP client, see NewGithubHTTPClient.
+func NewDaemon(cfg DaemonConfig, hc *http.Client, apiURL string, log *Logger) *Daemon {
+	d := &Daemon{cfg: cfg}
+	for _, qc := range cfg.Queues {
+		owner, repo, _ := qc.ownerAndRepo()
+		d.queues = append(d.queues, daemonQueue{
+			QueueConfig: qc,
+			client:      NewGithubClient(hc, apiURL, owner, repo, qc.Base, qc.Config),
+			log:         log.With("repo", qc.Repo, "base_branch", qc.Base),
+		})
+	}
+	return d
+}
+
+// RunOnce runs the state machine of each merge queue until a terminal state is
+// reached. A panic in the state machine of a merge queue is logged, and
+// doesn't prevent the others from running.
+func (d *Daemon) RunOnce() {
+	for _, q := range d.queues {
+		q.run(d.cfg.CommentLookback)
+	}
+}
+
+func (q daemonQueue) run(commentLookback time.Duration) {
+	defer q.recover("state machine failed")
+	StateMachine(q.client, q.Config, commentLookback, q.log)
+}
+
+// MigrateLegacyBranches renames the merge candidate branches of each merge
+// queue which were created by earlier versions, see MigrateLegacyBranches.
+// A panic while migrating the branches of a merge queue is logged, and
+// doesn't prevent the others from being migrated.
+func (d *Daemon) MigrateLegacyBranches() {
+	for _, q := range d.queues {
+		q.migrateLegacyBranches()
+	}
+}
+
+func (q daemonQueue) migrateLegacyBranches() {
+	defer q.recover("legacy branch migration failed")
+	MigrateLegacyBranches(q.client, q.log)
+}
+
+// recover logs a panic with the given message.
+func (q daemonQueue) recover(msg string) {
+	if r := recover(); r != nil {
+		q.log.Log(msg, "error", fmt.Sprint(r))
+	}
+}
+
+// Run migrates the legacy merge candidate branches, and then runs the merge
+// queues forever.
+func (d *Daemon) Run() {
+	if d.cfg.MetricsAddr != "" {
+		ServeMetrics(d.cfg.MetricsAddr)
+	}
+	d.MigrateLegacyBranches()
+	for {
+		d.RunOnce()
+		time.Sleep(d.cfg.PollInterval)
+	}
+}
+
+// RunDaemon parses the command line arguments of the daemon subcommand, and
+// runs the daemon. The github token is read from $GITHUB_TOKEN, and the github
+// API URL from $GITHUB_API_URL if set.
+func RunDaemon(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("config", "daemon.yaml", "daemon configuration file")
+	onErrPanic(fs.Parse(args))
+	cfg := ReadDaemonConfig(*configPath)
+	hc := NewGithubHTTPClient(os.Getenv("GITHUB_TOKEN"))
+	NewDaemon(cfg, hc, os.Getenv("GITHUB_API_URL"), NewLogger(os.Stderr)).Run()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDaemonConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	write("squash.yaml", "merge_strategy: squash\n")
+	dc := ReadDaemonConfig(write("daemon.yaml", `
+poll_interval: 30s
+queues:
+- repo: org/api
+  base: main
+  config: squash.yaml
+- repo: org/web
+  base: release-23.1
+`))
+	require.Equal(t, 30*time.Second, dc.PollInterval)
+	require.Equal(t, 7*24*time.Hour, dc.CommentLookback)
+	require.Len(t, dc.Queues, 2)
+	require.Equal(t, SquashStrategy, dc.Queues[0].Config.MergeStrategy)
+	require.Equal(t, DefaultConfig(), dc.Queues[1].Config)
+
+	for _, tc := range []struct{ yaml, err string }{
+		{"queues: []", "no queues"},
+		{"queues: [{repo: api, base: main}]", `invalid repo "api", expected owner/repo`},
+		{"queues: [{repo: org/api}]", "no base branch for repo org/api"},
+		{"queues: [{repo: org/api, base: main}, {repo: org/api, base: main}]",
+			"duplicate queue for org/api:main"},
+	} {
+		require.PanicsWithError(t, tc.err, func() {
+			ReadDaemonConfig(write("invalid.yaml", tc.yaml))
+		}, tc.yaml)
+	}
+}
+
+// TestDaemon runs a daemon against a FakeGithubServer, which only serves one
+// of the repos of the daemon. The state machine of the merge queue of the
+// other one fails, without preventing the merge queues of the two base
+// branches of the first from making progress. A merge candidate branch with a
+// legacy name gets migrated to the merge queue of its pull request.
+func TestDaemon(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main", "main:release-23.1", "main:merge-candidate-2-1")
+	for _, b := range []struct{ branch, base string }{
+		{"pr-1", "main"},
+		{"pr-2", "release-23.1"},
+	} {
+		runGit(t, work, "checkout", "-q", "-b", b.branch, "main")
+		commitFile(t, work, b.branch+".txt", b.branch)
+		runGit(t, work, "push", bare, b.branch)
+		adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+			"head": b.branch, "base": b.base, "title": "Add " + b.branch, "author": "alice",
+		})
+	}
+
+	cfg := DaemonConfig{
+		PollInterval:    time.Minute,
+		CommentLookback: time.Hour,
+		Queues: []QueueConfig{
+			{Repo: "other/repo", Base: "main", Config: DefaultConfig()},
+			{Repo: "owner/repo", Base: "main", Config: DefaultConfig()},
+			{Repo: "owner/repo", Base: "release-23.1", Config: DefaultConfig()},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	var buf bytes.Buffer
+	d := NewDaemon(cfg, NewGithubHTTPClient("token"), serverURL, NewLogger(&buf))
+	d.MigrateLegacyBranches()
+	require.Equal(t, []string{"main", "merge-candidate/release-23.1/2-1", "pr-1", "pr-2", "release-23.1"}, fake.git.branches())
+	require.Contains(t, buf.String(), `"base_branch":"release-23.1","branch":"merge-candidate-2-1","msg":"migrated legacy branch","repo":"owner/repo"`)
+
+	c := d.queues[1].client
+	c.PostComment(1, "bors merge")
+	c.PostComment(2, "bors merge")
+	d.RunOnce()
+
+	require.Equal(t, []string{
+		"main", "merge-candidate/main/1-1", "merge-candidate/release-23.1/2-1", "pr-1", "pr-2", "release-23.1",
+	}, fake.git.branches())
+	require.Contains(t, buf.String(), `"msg":"state machine failed","repo":"other/repo"`)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, `"msg":"created branch"`) {
+			require.Contains(t, line, `"repo":"owner/repo"`)
+		}
+	}
+}
@@ -0,0 +1,714 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/google/go-github/v36/github"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeGithubServer serves the parts of the github REST API which the
+// githubClientImpl uses, for a single repo, backed by an actual bare git
+// repository. The real client can point at it through its API URL, which makes
+// it possible to run the tool end to end without github.
+//
+// Pull requests, reviews and check suite outcomes are scripted through an
+// admin API under /_admin/:
+//
+//	POST  /_admin/pulls            {"head", "base", "title", "body", "author"}
+//	PATCH /_admin/pulls/N          {"state", "draft", "locked", "labels"}
+//	POST  /_admin/pulls/N/reviews  {"user", "state"}
+//	POST  /_admin/check-suites     {"ref", "name", "status", "conclusion"}
+//	PUT   /_admin/collaborators/U  {"permission"}
+//
+// Users are admins of the repo unless their permission is set otherwise.
+//
+// The head of a pull request is the head of its branch in the git repository,
+// and a pull request gets closed once its head is merged into its base branch,
+// after which the pull requests stacked on top of it target that base branch.
+type FakeGithubServer struct {
+	owner, repo string
+	git         fakeGitStore
+	mu          sync.Mutex
+	pulls       map[int]*fakePullRequest
+	comments    []*github.IssueComment
+	checkSuites map[string][]*github.CheckSuite
+	permissions map[string]string
+	numIDs      int64
+}
+
+type fakePullRequest struct {
+	number                      int
+	headRef, baseRef            string
+	title, body, author         string
+	isClosed, isDraft, isLocked bool
+	isMerged                    bool
+	labels                      []string
+	reviews                     []*github.PullRequestReview
+}
+
+// NewFakeGithubServer returns a FakeGithubServer for the owner/repo, backed by
+// the bare git repository in gitDir, which is created if needed.
+// Any errors will result in a panic.
+func NewFakeGithubServer(owner, repo, gitDir string) *FakeGithubServer {
+	s := &FakeGithubServer{
+		owner:       owner,
+		repo:        repo,
+		git:         fakeGitStore{dir: gitDir},
+		pulls:       map[int]*fakePullRequest{},
+		checkSuites: map[string][]*github.CheckSuite{},
+		permissions: map[string]string{},
+	}
+	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
+		_, err = s.git.run(nil, "init", "--bare", "--initial-branch=main", gitDir)
+		onErrPanic(err)
+	}
+	return s
+}
+
+// RunFakeGithubServer runs the fake-github command, which serves a
+// FakeGithubServer until killed.
+// Any errors will result in a panic.
+func RunFakeGithubServer(args []string) {
+	fs := flag.NewFlagSet("fake-github", flag.PanicOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "address to listen on")
+	owner := fs.String("owner", "owner", "repo owner")
+	repo := fs.String("repo", "repo", "repo name")
+	gitDir := fs.String("git-dir", "fake-github.git", "bare git repository backing the repo")
+	onErrPanic(fs.Parse(args))
+	fmt.Printf("serving %s/%s from %s on http://%s/\n", *owner, *repo, *gitDir, *addr)
+	onErrPanic(http.ListenAndServe(*addr, NewFakeGithubServer(*owner, *repo, *gitDir)))
+}
+
+// fakeHTTPError is the panic value with which handlers respond with an error.
+type fakeHTTPError struct {
+	status int
+	msg    string
+}
+
+func fakeError(status int, format string, args ...interface{}) {
+	panic(fakeHTTPError{status: status, msg: fmt.Sprintf(format, args...)})
+}
+
+func (s *FakeGithubServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() {
+		if p := recover(); p != nil {
+			e, ok := p.(fakeHTTPError)
+			if !ok {
+				e = fakeHTTPError{status: http.StatusInternalServerError, msg: fmt.Sprint(p)}
+			}
+			writeJSON(w, e.status, map[string]string{"message": e.msg})
+		}
+	}()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 0 && parts[0] == "_admin" {
+		s.serveAdmin(w, r, parts[1:])
+		return
+	}
+	if len(parts) < 4 || parts[0] != "repos" || parts[1] != s.owner || parts[2] != s.repo {
+		fakeError(http.StatusNotFound, "Not Found")
+	}
+	route := r.Method + " " + parts[3]
+	rest := parts[4:]
+	switch {
+	case route == "GET branches" && len(rest) == 0:
+		s.listBranches(w, r)
+	case route == "GET branches" && len(rest) > 0:
+		s.getBranch(w, strings.Join(rest, "/"))
+	case route == "POST git" && len(rest) == 1 && rest[0] == "refs":
+		s.createRef(w, r)
+	case route == "PATCH git" && len(rest) > 2 && rest[0] == "refs" && rest[1] == "heads":
+		s.updateRef(w, r, strings.Join(rest[2:], "/"))
+	case route == "DELETE git" && len(rest) > 2 && rest[0] == "refs" && rest[1] == "heads":
+		s.deleteRef(w, strings.Join(rest[2:], "/"))
+	case route == "POST git" && len(rest) == 1 && rest[0] == "commits":
+		s.createCommit(w, r)
+	case route == "POST merges" && len(rest) == 0:
+		s.merge(w, r)
+	case route == "GET pulls" && len(rest) == 0:
+		s.listPullRequests(w, r)
+	case route == "GET pulls" && len(rest) == 1:
+		s.getPullRequest(w, s.pullRequest(rest[0]))
+	case route == "GET pulls" && len(rest) == 2 && rest[1] == "reviews":
+		writeJSON(w, http.StatusOK, paginate(w, r, s.pullRequest(rest[0]).reviews))
+	case route == "GET pulls" && len(rest) == 2 && rest[1] == "commits":
+		s.listPullRequestCommits(w, r, s.pullRequest(rest[0]))
+	case route == "GET pulls" && len(rest) == 2 && rest[1] == "files":
+		s.listPullRequestFiles(w, r, s.pullRequest(rest[0]))
+	case route == "GET collaborators" && len(rest) == 2 && rest[1] == "permission":
+		s.getPermissionLevel(w, rest[0])
+	case route == "GET issues" && len(rest) == 1 && rest[0] == "comments":
+		s.listComments(w, r)
+	case route == "GET issues" && len(rest) == 2 && rest[1] == "comments":
+		s.listIssueComments(w, r, s.pullRequest(rest[0]))
+	case route == "POST issues" && len(rest) == 2 && rest[1] == "comments":
+		s.createComment(w, r, s.pullRequest(rest[0]))
+	case route == "GET commits" && len(rest) == 2 && rest[1] == "check-suites":
+		suites := s.checkSuites[s.git.resolve(rest[0])]
+		writeJSON(w, http.StatusOK, &github.ListCheckSuiteResults{
+			Total:       github.Int(len(suites)),
+			CheckSuites: paginate(w, r, suites).([]*github.CheckSuite),
+		})
+	default:
+		fakeError(http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *FakeGithubServer) listBranches(w http.ResponseWriter, r *http.Request) {
+	var branches []*github.Branch
+	for _, name := range s.git.branches() {
+		sha := s.git.resolve("refs/heads/" + name)
+		branches = append(branches, &github.Branch{
+			Name:   github.String(name),
+			Commit: &github.RepositoryCommit{SHA: github.String(sha)},
+		})
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, branches))
+}
+
+func (s *FakeGithubServer) getBranch(w http.ResponseWriter, name string) {
+	sha := s.git.resolve("refs/heads/" + name)
+	if sha == "" {
+		fakeError(http.StatusNotFound, "Branch not found")
+	}
+	writeJSON(w, http.StatusOK, &github.Branch{
+		Name:   github.String(name),
+		Commit: s.git.repositoryCommit(sha),
+	})
+}
+
+func (s *FakeGithubServer) createRef(w http.ResponseWriter, r *http.Request) {
+	var req struct{ Ref, SHA string }
+	readJSON(r, &req)
+	if !strings.HasPrefix(req.Ref, "refs/heads/") {
+		fakeError(http.StatusUnprocessableEntity, "Reference name is invalid")
+	}
+	if s.git.resolve(req.Ref) != "" {
+		fakeError(http.StatusUnprocessableEntity, "Reference already exists")
+	}
+	s.git.updateRef(req.Ref, s.git.mustResolve(req.SHA))
+	writeJSON(w, http.StatusCreated, s.reference(req.Ref))
+}
+
+func (s *FakeGithubServer) updateRef(w http.ResponseWriter, r *http.Request, name string) {
+	var req struct {
+		SHA   string
+		Force bool
+	}
+	readJSON(r, &req)
+	ref := "refs/heads/" + name
+	old := s.git.resolve(ref)
+	if old == "" {
+		fakeError(http.StatusUnprocessableEntity, "Reference does not exist")
+	}
+	sha := s.git.mustResolve(req.SHA)
+	if !req.Force && !s.git.isAncestor(old, sha) {
+		fakeError(http.StatusUnprocessableEntity, "Update is not a fast forward")
+	}
+	s.git.updateRef(ref, sha)
+	s.closeMergedPullRequests()
+	writeJSON(w, http.StatusOK, s.reference(ref))
+}
+
+func (s *FakeGithubServer) deleteRef(w http.ResponseWriter, name string) {
+	ref := "refs/heads/" + name
+	if s.git.resolve(ref) == "" {
+		fakeError(http.StatusUnprocessableEntity, "Reference does not exist")
+	}
+	_, err := s.git.run(nil, "update-ref", "-d", ref)
+	onErrPanic(err)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *FakeGithubServer) createCommit(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message string
+		Tree    string
+		Parents []string
+		Author  *github.CommitAuthor
+	}
+	readJSON(r, &req)
+	sha := s.git.commitTree(req.Tree, req.Parents, req.Message, req.Author)
+	writeJSON(w, http.StatusCreated, s.git.repositoryCommit(sha).Commit)
+}
+
+func (s *FakeGithubServer) merge(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Base, Head    string
+		CommitMessage string `json:"commit_message"`
+	}
+	readJSON(r, &req)
+	ref := "refs/heads/" + req.Base
+	base := s.git.resolve(ref)
+	if base == "" {
+		fakeError(http.StatusNotFound, "Base does not exist")
+	}
+	head := s.git.mustResolve(req.Head)
+	if s.git.isAncestor(head, base) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	tree, ok := s.git.mergeTree(base, head)
+	if !ok {
+		fakeError(http.StatusConflict, "Merge conflict")
+	}
+	if req.CommitMessage == "" {
+		req.CommitMessage = fmt.Sprintf("Merge %s into %s", req.Head, req.Base)
+	}
+	sha := s.git.commitTree(tree, []string{base, head}, req.CommitMessage, nil)
+	s.git.updateRef(ref, sha)
+	writeJSON(w, http.StatusCreated, s.git.repositoryCommit(sha))
+}
+
+func (s *FakeGithubServer) getPullRequest(w http.ResponseWriter, pr *fakePullRequest) {
+	writeJSON(w, http.StatusOK, s.pullRequestJSON(pr))
+}
+
+// listPullRequests lists the pull requests, filtered by state and head branch
+// as github does.
+func (s *FakeGithubServer) listPullRequests(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	state := q.Get("state")
+	if state == "" {
+		state = "open"
+	}
+	numbers := make([]int, 0, len(s.pulls))
+	for number := range s.pulls {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var prs []*github.PullRequest
+	for _, number := range numbers {
+		pr := s.pulls[number]
+		if state != "all" && pr.isClosed != (state == "closed") {
+			continue
+		}
+		if head := q.Get("head"); head != "" && head != s.owner+":"+pr.headRef {
+			continue
+		}
+		prs = append(prs, s.pullRequestJSON(pr))
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, prs))
+}
+
+func (s *FakeGithubServer) pullRequestJSON(pr *fakePullRequest) *github.PullRequest {
+	head := s.git.mustResolve("refs/heads/" + pr.headRef)
+	base := s.git.mustResolve("refs/heads/" + pr.baseRef)
+	ret := &github.PullRequest{
+		Number: github.Int(pr.number),
+		State:  github.String("open"),
+		Locked: github.Bool(pr.isLocked),
+		Draft:  github.Bool(pr.isDraft),
+		Title:  github.String(pr.title),
+		Body:   github.String(pr.body),
+		User:   &github.User{Login: github.String(pr.author)},
+		Head:   &github.PullRequestBranch{Ref: github.String(pr.headRef), SHA: github.String(head)},
+		Base:   &github.PullRequestBranch{Ref: github.String(pr.baseRef), SHA: github.String(base)},
+		Merged: github.Bool(pr.isMerged),
+	}
+	if pr.isClosed {
+		ret.State = github.String("closed")
+	} else {
+		_, isMergeable := s.git.mergeTree(base, head)
+		ret.Mergeable = github.Bool(isMergeable)
+	}
+	for _, label := range pr.labels {
+		ret.Labels = append(ret.Labels, &github.Label{Name: github.String(label)})
+	}
+	return ret
+}
+
+func (s *FakeGithubServer) listPullRequestCommits(w http.ResponseWriter, r *http.Request, pr *fakePullRequest) {
+	head := s.git.mustResolve("refs/heads/" + pr.headRef)
+	base := s.git.mustResolve("refs/heads/" + pr.baseRef)
+	out, err := s.git.run(nil, "rev-list", "--reverse", head, "^"+base)
+	onErrPanic(err)
+	var commits []*github.RepositoryCommit
+	for _, sha := range strings.Fields(out) {
+		commits = append(commits, s.git.repositoryCommit(sha))
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, commits))
+}
+
+func (s *FakeGithubServer) listPullRequestFiles(w http.ResponseWriter, r *http.Request, pr *fakePullRequest) {
+	head := s.git.mustResolve("refs/heads/" + pr.headRef)
+	base := s.git.mustResolve("refs/heads/" + pr.baseRef)
+	out, err := s.git.run(nil, "diff", "--name-only", base+"..."+head)
+	onErrPanic(err)
+	var files []*github.CommitFile
+	for _, name := range strings.Fields(out) {
+		files = append(files, &github.CommitFile{Filename: github.String(name)})
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, files))
+}
+
+func (s *FakeGithubServer) listComments(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			fakeError(http.StatusUnprocessableEntity, "Invalid since")
+		}
+	}
+	var comments []*github.IssueComment
+	for _, c := range s.comments {
+		if !c.GetCreatedAt().Before(since) {
+			comments = append(comments, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, comments))
+}
+
+func (s *FakeGithubServer) listIssueComments(w http.ResponseWriter, r *http.Request, pr *fakePullRequest) {
+	suffix := fmt.Sprintf("/issues/%d", pr.number)
+	var comments []*github.IssueComment
+	for _, c := range s.comments {
+		if strings.HasSuffix(c.GetIssueURL(), suffix) {
+			comments = append(comments, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, paginate(w, r, comments))
+}
+
+func (s *FakeGithubServer) createComment(w http.ResponseWriter, r *http.Request, pr *fakePullRequest) {
+	var req struct{ Body string }
+	readJSON(r, &req)
+	s.numIDs++
+	now := time.Now()
+	c := &github.IssueComment{
+		ID:        github.Int64(s.numIDs),
+		Body:      github.String(req.Body),
+		User:      &github.User{Login: github.String("bot")},
+		CreatedAt: &now,
+		IssueURL:  github.String(fmt.Sprintf("http://%s/repos/%s/%s/issues/%d", r.Host, s.owner, s.repo, pr.number)),
+	}
+	s.comments = append(s.comments, c)
+	writeJSON(w, http.StatusCreated, c)
+}
+
+func (s *FakeGithubServer) getPermissionLevel(w http.ResponseWriter, login string) {
+	permission, ok := s.permissions[login]
+	if !ok {
+		permission = "admin"
+	}
+	// Each permission implies the ones after it.
+	permissions := map[string]bool{}
+	isGranted := false
+	for _, p := range []string{"admin", "maintain", "push", "triage", "pull"} {
+		isGranted = isGranted || p == permission
+		permissions[p] = isGranted
+	}
+	// Like github, the legacy permission only has admin, write and read.
+	legacy := map[string]string{"maintain": "write", "push": "write", "triage": "read", "pull": "read"}[permission]
+	if legacy == "" {
+		legacy = permission
+	}
+	writeJSON(w, http.StatusOK, &github.RepositoryPermissionLevel{
+		Permission: github.String(legacy),
+		User:       &github.User{Login: github.String(login), Permissions: permissions},
+	})
+}
+
+func (s *FakeGithubServer) serveAdmin(w http.ResponseWriter, r *http.Request, parts []string) {
+	route := r.Method + " " + strings.Join(parts, "/")
+	switch {
+	case route == "POST pulls":
+		var req struct{ Head, Base, Title, Body, Author string }
+		readJSON(r, &req)
+		if req.Base == "" {
+			req.Base = "main"
+		}
+		s.git.mustResolve("refs/heads/" + req.Head)
+		s.git.mustResolve("refs/heads/" + req.Base)
+		pr := &fakePullRequest{
+			number:  len(s.pulls) + 1,
+			headRef: req.Head,
+			baseRef: req.Base,
+			title:   req.Title,
+			body:    req.Body,
+			author:  req.Author,
+		}
+		s.pulls[pr.number] = pr
+		s.getPullRequest(w, pr)
+	case r.Method == "PATCH" && len(parts) == 2 && parts[0] == "pulls":
+		pr := s.pullRequest(parts[1])
+		var req struct {
+			State         *string
+			Draft, Locked *bool
+			Labels        []string
+		}
+		readJSON(r, &req)
+		if req.State != nil {
+			pr.isClosed = *req.State == "closed"
+		}
+		if req.Draft != nil {
+			pr.isDraft = *req.Draft
+		}
+		if req.Locked != nil {
+			pr.isLocked = *req.Locked
+		}
+		if req.Labels != nil {
+			pr.labels = req.Labels
+		}
+		s.getPullRequest(w, pr)
+	case r.Method == "POST" && len(parts) == 3 && parts[0] == "pulls" && parts[2] == "reviews":
+		pr := s.pullRequest(parts[1])
+		var req struct{ User, State string }
+		readJSON(r, &req)
+		s.numIDs++
+		review := &github.PullRequestReview{
+			ID:    github.Int64(s.numIDs),
+			User:  &github.User{Login: github.String(req.User)},
+			State: github.String(req.State),
+		}
+		pr.reviews = append(pr.reviews, review)
+		writeJSON(w, http.StatusCreated, review)
+	case r.Method == "PUT" && len(parts) == 2 && parts[0] == "collaborators":
+		var req struct{ Permission string }
+		readJSON(r, &req)
+		s.permissions[parts[1]] = req.Permission
+		s.getPermissionLevel(w, parts[1])
+	case route == "POST check-suites":
+		var req struct{ Ref, Name, Status, Conclusion string }
+		readJSON(r, &req)
+		sha := s.git.mustResolve(req.Ref)
+		if req.Name == "" {
+			req.Name = "ci"
+		}
+		suite := &github.CheckSuite{
+			HeadSHA: github.String(sha),
+			App:     &github.App{Name: github.String(req.Name)},
+			Status:  github.String(req.Status),
+		}
+		if req.Conclusion != "" {
+			suite.Conclusion = github.String(req.Conclusion)
+		}
+		suites := s.checkSuites[sha][:0:0]
+		for _, other := range s.checkSuites[sha] {
+			if other.GetApp().GetName() != req.Name {
+				suites = append(suites, other)
+			}
+		}
+		s.checkSuites[sha] = append(suites, suite)
+		writeJSON(w, http.StatusCreated, suite)
+	default:
+		fakeError(http.StatusNotFound, "Not Found")
+	}
+}
+
+func (s *FakeGithubServer) pullRequest(number string) *fakePullRequest {
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		fakeError(http.StatusNotFound, "Not Found")
+	}
+	pr, ok := s.pulls[n]
+	if !ok {
+		fakeError(http.StatusNotFound, "Not Found")
+	}
+	return pr
+}
+
+// closeMergedPullRequests closes the pull requests whose heads have been
+// merged into their base branches.
+func (s *FakeGithubServer) closeMergedPullRequests() {
+	for isChanged := true; isChanged; {
+		isChanged = false
+		for _, pr := range s.pulls {
+			if pr.isClosed {
+				continue
+			}
+			head := s.git.resolve("refs/heads/" + pr.headRef)
+			base := s.git.resolve("refs/heads/" + pr.baseRef)
+			if head == "" || base == "" || !s.git.isAncestor(head, base) {
+				continue
+			}
+			pr.isClosed, pr.isMerged = true, true
+			isChanged = true
+			// Retarget the pull requests stacked on top of the merged one, as
+			// github does once its head branch gets deleted.
+			for _, other := range s.pulls {
+				if !other.isClosed && other.baseRef == pr.headRef {
+					other.baseRef = pr.baseRef
+				}
+			}
+		}
+	}
+}
+
+func (s *FakeGithubServer) reference(ref string) *github.Reference {
+	return &github.Reference{
+		Ref:    github.String(ref),
+		Object: &github.GitObject{Type: github.String("commit"), SHA: github.String(s.git.resolve(ref))},
+	}
+}
+
+// paginate returns the requested page of a slice, and sets the Link header
+// when there is a next page.
+func paginate(w http.ResponseWriter, r *http.Request, items interface{}) interface{} {
+	q := r.URL.Query()
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 {
+		perPage = 30
+	}
+	v := reflect.ValueOf(items)
+	n := v.Len()
+	start, end := (page-1)*perPage, page*perPage
+	if start > n {
+		start = n
+	}
+	if end >= n {
+		end = n
+	} else {
+		q.Set("page", strconv.Itoa(page+1))
+		next := url.URL{Scheme: "http", Host: r.Host, Path: r.URL.Path, RawQuery: q.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+	if n == 0 {
+		// Github responds with an empty array rather than null.
+		return reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+	return v.Slice(start, end).Interface()
+}
+
+func readJSON(r *http.Request, v interface{}) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		fakeError(http.StatusBadRequest, "Problems parsing JSON")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// fakeGitStore runs git commands against a bare repository.
+type fakeGitStore struct {
+	dir string
+}
+
+func (g fakeGitStore) run(env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", g.dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=merge-candidate", "GIT_AUTHOR_EMAIL=merge-candidate@localhost",
+		"GIT_COMMITTER_NAME=merge-candidate", "GIT_COMMITTER_EMAIL=merge-candidate@localhost")
+	cmd.Env = append(cmd.Env, env...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("git %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// resolve returns the commit which a ref or a commit ID refers to, or an empty
+// string if there is none.
+func (g fakeGitStore) resolve(rev string) string {
+	out, err := g.run(nil, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func (g fakeGitStore) mustResolve(rev string) string {
+	sha := g.resolve(rev)
+	if sha == "" {
+		fakeError(http.StatusUnprocessableEntity, "No commit found for %s", rev)
+	}
+	return sha
+}
+
+func (g fakeGitStore) updateRef(ref, sha string) {
+	_, err := g.run(nil, "update-ref", ref, sha)
+	onErrPanic(err)
+}
+
+func (g fakeGitStore) isAncestor(ancestor, descendant string) bool {
+	_, err := g.run(nil, "merge-base", "--is-ancestor", ancestor, descendant)
+	return err == nil
+}
+
+func (g fakeGitStore) branches() []string {
+	out, err := g.run(nil, "for-each-ref", "--format=%(refname:strip=2)", "refs/heads/")
+	onErrPanic(err)
+	names := strings.Fields(out)
+	sort.Strings(names)
+	return names
+}
+
+// mergeTree returns the tree resulting from merging two commits, unless there
+// is a merge conflict.
+func (g fakeGitStore) mergeTree(a, b string) (tree string, ok bool) {
+	out, err := g.run(nil, "merge-tree", "--write-tree", "--no-messages", a, b)
+	if err != nil {
+		// The exit status is 1 iff there are conflicts.
+		if !strings.Contains(err.Error(), "exit status 1") {
+			onErrPanic(err)
+		}
+		return "", false
+	}
+	return strings.TrimSpace(strings.Split(out, "\n")[0]), true
+}
+
+func (g fakeGitStore) commitTree(tree string, parents []string, msg string, author *github.CommitAuthor) string {
+	args := []string{"commit-tree", tree, "-m", msg}
+	for _, p := range parents {
+		args = append(args, "-p", g.mustResolve(p))
+	}
+	var env []string
+	if author != nil {
+		env = append(env, "GIT_AUTHOR_NAME="+author.GetName(), "GIT_AUTHOR_EMAIL="+author.GetEmail())
+		if author.Date != nil {
+			env = append(env, "GIT_AUTHOR_DATE="+author.GetDate().Format(time.RFC3339))
+		}
+	}
+	out, err := g.run(env, args...)
+	if err != nil {
+		fakeError(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return strings.TrimSpace(out)
+}
+
+// repositoryCommit describes a commit like the github API does.
+func (g fakeGitStore) repositoryCommit(sha string) *github.RepositoryCommit {
+	out, err := g.run(nil, "show", "--no-patch", "--format=%T%n%P%n%an%n%ae%n%aI%n%B", sha)
+	onErrPanic(err)
+	lines := strings.SplitN(out, "\n", 6)
+	date, err := time.Parse(time.RFC3339, lines[4])
+	onErrPanic(err)
+	commit := &github.Commit{
+		SHA:     github.String(sha),
+		Tree:    &github.Tree{SHA: github.String(lines[0])},
+		Message: github.String(strings.TrimSuffix(lines[5], "\n")),
+		Author: &github.CommitAuthor{
+			Name:  github.String(lines[2]),
+			Email: github.String(lines[3]),
+			Date:  &date,
+		},
+	}
+	rc := &github.RepositoryCommit{SHA: github.String(sha), Commit: commit}
+	for _, p := range strings.Fields(lines[1]) {
+		rc.Parents = append(rc.Parents, &github.Commit{SHA: github.String(p)})
+		commit.Parents = append(commit.Parents, &github.Commit{SHA: github.String(p)})
+	}
+	return rc
+}
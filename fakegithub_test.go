@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFakeGithubServer runs the state machine end to end with the actual
+// github client against a FakeGithubServer: two pull requests get merged,
+// while a third one conflicts with the first and gets blocked.
+func TestFakeGithubServer(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+
+	// Push a base branch and the pull request branches.
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	for _, b := range []struct{ branch, file, content string }{
+		{"pr-1", "a.txt", "1"},
+		{"pr-2", "b.txt", "2"},
+		{"pr-3", "a.txt", "3"},
+	} {
+		runGit(t, work, "checkout", "-q", "-b", b.branch, "main")
+		commitFile(t, work, b.file, b.content)
+		runGit(t, work, "push", bare, b.branch)
+		adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+			"head": b.branch, "title": "Add " + b.file, "author": "alice",
+		})
+	}
+
+	cfg := DefaultConfig()
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	for number := PullRequestNumber(1); number <= 3; number++ {
+		c.PostComment(number, "bors merge")
+	}
+	StateMachine(c, cfg, time.Hour, nil)
+	// The merge candidate branches of the third pull request on top of the
+	// first one got deleted.
+	require.Equal(t, []string{
+		"main",
+		"merge-candidate/main/1-1",
+		"merge-candidate/main/2-1", "merge-candidate/main/2-2",
+		"merge-candidate/main/3-1", "merge-candidate/main/3-3",
+		"pr-1", "pr-2", "pr-3",
+	}, fake.git.branches())
+
+	// The checks pass for the first two pull requests merged together.
+	for _, ref := range []string{"merge-candidate/main/1-1", "merge-candidate/main/2-2"} {
+		adminRequest(t, serverURL, "POST", "/_admin/check-suites", map[string]string{
+			"ref": ref, "status": "completed", "conclusion": "success",
+		})
+	}
+	StateMachine(c, cfg, time.Hour, nil)
+	main := fake.git.resolve("refs/heads/main")
+	require.True(t, fake.git.isAncestor(fake.git.resolve("refs/heads/pr-1"), main))
+	require.True(t, fake.git.isAncestor(fake.git.resolve("refs/heads/pr-2"), main))
+	// The third pull request conflicts with the base branch now.
+	require.Equal(t, []string{"main", "pr-1", "pr-2", "pr-3"}, fake.git.branches())
+	for number, isOpen := range map[PullRequestNumber]bool{1: false, 2: false, 3: true} {
+		pr := c.GetPullRequest(context.Background(), number)
+		require.Equal(t, isOpen, pr.IsOpen, "#%d", number)
+	}
+	require.True(t, c.GetPullRequest(context.Background(), 3).HasConflicts)
+}
+
+// TestFakeGithubDependencyStatus checks the status of a pull request which
+// other pull requests depend on, as its merge gets cancelled, fails, and
+// finally succeeds.
+func TestFakeGithubDependencyStatus(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	_, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	runGit(t, work, "checkout", "-q", "-b", "pr-1")
+	commitFile(t, work, "a.txt", "1")
+	runGit(t, work, "push", bare, "pr-1")
+	adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+		"head": "pr-1", "title": "Add a.txt", "author": "alice",
+	})
+
+	cfg := DefaultConfig()
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	ref := PullRequestRef{Repo: "owner/repo", Number: 1}
+	require.Equal(t, DependencyPending, c.GetDependencyStatus(ref))
+	c.PostComment(1, "bors merge")
+	c.PostComment(1, "bors cancel")
+	require.Equal(t, DependencyCancelled, c.GetDependencyStatus(ref))
+
+	c.PostComment(1, "bors merge")
+	StateMachine(c, cfg, time.Hour, nil)
+	require.Equal(t, DependencyPending, c.GetDependencyStatus(ref))
+	adminRequest(t, serverURL, "POST", "/_admin/check-suites", map[string]string{
+		"ref": "merge-candidate/main/1-1", "status": "completed", "conclusion": "failure",
+	})
+	require.Equal(t, DependencyFailed, c.GetDependencyStatus(ref))
+
+	adminRequest(t, serverURL, "POST", "/_admin/check-suites", map[string]string{
+		"ref": "merge-candidate/main/1-1", "status": "completed", "conclusion": "success",
+	})
+	StateMachine(c, cfg, time.Hour, nil)
+	require.Equal(t, DependencyMerged, c.GetDependencyStatus(ref))
+}
+
+// TestFakeGithubStackedPullRequests checks that a pull request whose base
+// branch is the head branch of another one only gets merged on top of it.
+func TestFakeGithubStackedPullRequests(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	for _, b := range []struct{ branch, base string }{{"pr-1", "main"}, {"pr-2", "pr-1"}} {
+		runGit(t, work, "checkout", "-q", "-b", b.branch)
+		commitFile(t, work, b.branch+".txt", b.branch)
+		runGit(t, work, "push", bare, b.branch)
+		adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+			"head": b.branch, "base": b.base, "title": "Add " + b.branch, "author": "alice",
+		})
+	}
+
+	cfg := DefaultConfig()
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	require.Equal(t, PullRequestNumber(1), c.GetPullRequest(context.Background(), 2).StackedOn)
+	c.PostComment(1, "bors merge")
+	c.PostComment(2, "bors merge")
+	StateMachine(c, cfg, time.Hour, nil)
+	require.Equal(t, []string{
+		"main", "merge-candidate/main/1-1", "merge-candidate/main/2-1", "pr-1", "pr-2",
+	}, fake.git.branches())
+
+	for _, ref := range []string{"merge-candidate/main/1-1", "merge-candidate/main/2-1"} {
+		adminRequest(t, serverURL, "POST", "/_admin/check-suites", map[string]string{
+			"ref": ref, "status": "completed", "conclusion": "success",
+		})
+	}
+	StateMachine(c, cfg, time.Hour, nil)
+	require.Equal(t, []string{"main", "pr-1", "pr-2"}, fake.git.branches())
+	for number := PullRequestNumber(1); number <= 2; number++ {
+		require.False(t, c.GetPullRequest(context.Background(), number).IsOpen, "#%d", number)
+	}
+}
+
+// TestFakeGithubIdempotentBranchCreation checks that creating a merge
+// candidate branch and merging a pull request into it can be done again, as
+// after an interrupted run, without failing or merging it twice.
+func TestFakeGithubIdempotentBranchCreation(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	runGit(t, work, "checkout", "-q", "-b", "pr-1")
+	commitFile(t, work, "a.txt", "1")
+	runGit(t, work, "push", bare, "pr-1")
+	adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+		"head": "pr-1", "title": "Add a.txt", "author": "alice",
+	})
+
+	cfg := DefaultConfig()
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	bk := BranchKey{PullRequestNumber: 1, PipelineCounter: 1}
+	base := c.GetBaseHead()
+	prs := []MergedPullRequest{{Number: 1, Head: CommitID(fake.git.resolve("refs/heads/pr-1"))}}
+	c.CreateBranch(bk, base)
+	c.CreateBranch(bk, base)
+	require.Equal(t, Merged, c.MergeBranch(bk, prs))
+	bv := c.GetBranch(bk)
+	require.True(t, bv.isValid)
+	require.Equal(t, Merged, c.MergeBranch(bk, prs))
+	require.Equal(t, bv.CommitID, c.GetBranch(bk).CommitID)
+
+	// Creating the branch again resets it.
+	c.CreateBranch(bk, base)
+	require.False(t, c.GetBranch(bk).isValid)
+	require.Equal(t, base, c.GetBranch(bk).CommitID)
+}
+
+// startFakeGithubServer starts a FakeGithubServer for owner/repo, backed by
+// the bare git repository at the given path, until the end of the test.
+func startFakeGithubServer(t *testing.T, gitDir string) (*FakeGithubServer, string) {
+	fake := NewFakeGithubServer("owner", "repo", gitDir)
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(cmd.Env,
+		"GIT_AUTHOR_NAME=alice", "GIT_AUTHOR_EMAIL=alice@localhost",
+		"GIT_COMMITTER_NAME=alice", "GIT_COMMITTER_EMAIL=alice@localhost",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+func commitFile(t *testing.T, work, name, content string) {
+	require.NoError(t, ioutil.WriteFile(filepath.Join(work, name), []byte(content), 0644))
+	runGit(t, work, "add", name)
+	runGit(t, work, "commit", "-q", "-m", "Add "+name)
+}
+
+func adminRequest(t *testing.T, serverURL, method, path string, body interface{}) {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req, err := http.NewRequest(method, serverURL+path, bytes.NewReader(data))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+	require.True(t, resp.StatusCode < 300, "%s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// TestFakeGithubFreeze checks that the freeze of the merge queue is kept in
+// the repo, and that freezing and unfreezing it are idempotent.
+// TestFakeGithubFastForwardRejected checks that a fast-forward which github
+// rejects although the base branch didn't move, as a branch protection rule
+// would, is an error rather than a conflict.
+func TestFakeGithubFastForwardRejected(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	runGit(t, work, "checkout", "-q", "--orphan", "unrelated")
+	commitFile(t, work, "README", "unrelated")
+	runGit(t, work, "push", bare, "unrelated")
+
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", DefaultConfig())
+	base := c.GetBaseHead()
+	require.Panics(t, func() { c.FastForwardBase(base, CommitID(fake.git.resolve("refs/heads/unrelated"))) })
+	require.Equal(t, base, c.GetBaseHead())
+}
+
+func TestFakeGithubFreeze(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", DefaultConfig())
+	require.False(t, c.IsFrozen())
+	c.SetFrozen(true)
+	c.SetFrozen(true)
+	require.True(t, c.IsFrozen())
+	require.Equal(t, fake.git.resolve("refs/heads/main"), fake.git.resolve("refs/heads/merge-freeze/main"))
+	c.SetFrozen(false)
+	c.SetFrozen(false)
+	require.False(t, c.IsFrozen())
+
+	// Only admins and maintainers may freeze the merge queue.
+	require.True(t, c.IsMaintainer("alice"))
+	for permission, isMaintainer := range map[string]bool{"maintain": true, "push": false, "none": false} {
+		adminRequest(t, serverURL, "PUT", "/_admin/collaborators/bob", map[string]string{"permission": permission})
+		require.Equal(t, isMaintainer, c.IsMaintainer("bob"), permission)
+	}
+}
+
+// TestFakeGithubSquashBranch checks that squashed commits are authored by the
+// author of the pull request, and that squashing a pull request whose head is
+// already in the merge candidate branch records the trailers regardless.
+func TestFakeGithubSquashBranch(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	runGit(t, work, "checkout", "-q", "-b", "pr-1")
+	commitFile(t, work, "a.txt", "1")
+	runGit(t, work, "push", bare, "pr-1")
+	adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+		"head": "pr-1", "title": "Add a.txt", "author": "alice",
+	})
+
+	cfg := DefaultConfig()
+	cfg.MergeStrategy = SquashStrategy
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	head := CommitID(fake.git.resolve("refs/heads/pr-1"))
+	prs := []MergedPullRequest{{Number: 1, Head: head}}
+
+	bk := BranchKey{PullRequestNumber: 1, PipelineCounter: 1}
+	c.CreateBranch(bk, c.GetBaseHead())
+	require.Equal(t, Merged, c.MergeBranch(bk, prs))
+	bv := c.GetBranch(bk)
+	require.True(t, bv.isValid)
+	author := fake.git.repositoryCommit(string(bv.CommitID)).GetCommit().GetAuthor()
+	require.Equal(t, "alice", author.GetName())
+	require.Equal(t, "alice@users.noreply.github.com", author.GetEmail())
+
+	// There is nothing to merge.
+	bk = BranchKey{PullRequestNumber: 1, PipelineCounter: 2}
+	c.CreateBranch(bk, head)
+	require.Equal(t, Merged, c.MergeBranch(bk, prs))
+	bv = c.GetBranch(bk)
+	require.True(t, bv.isValid)
+	require.Equal(t, prs, bv.MergedPullRequests)
+	require.Equal(t, []CommitID{head}, bv.Parents)
+}
+
+// TestFakeGithubRebaseStaleHead checks that rebasing a pull request which was
+// pushed to since its head was fetched doesn't look like a merge conflict, and
+// leaves the merge candidate branch as it was created.
+func TestFakeGithubRebaseStaleHead(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	bare := filepath.Join(dir, "repo.git")
+	fake, serverURL := startFakeGithubServer(t, bare)
+	work := filepath.Join(dir, "work")
+	runGit(t, dir, "init", "--initial-branch=main", work)
+	commitFile(t, work, "README", "base")
+	runGit(t, work, "push", bare, "main")
+	runGit(t, work, "checkout", "-q", "-b", "pr-1")
+	commitFile(t, work, "a.txt", "1")
+	runGit(t, work, "push", bare, "pr-1")
+	adminRequest(t, serverURL, "POST", "/_admin/pulls", map[string]string{
+		"head": "pr-1", "title": "Add a.txt", "author": "alice",
+	})
+
+	cfg := DefaultConfig()
+	cfg.MergeStrategy = RebaseStrategy
+	c := NewGithubClient(NewGithubHTTPClient("token"), serverURL, "owner", "repo", "main", cfg)
+	prs := []MergedPullRequest{{Number: 1, Head: CommitID(fake.git.resolve("refs/heads/pr-1"))}}
+
+	// The pull request gets pushed to after its head was fetched.
+	commitFile(t, work, "b.txt", "2")
+	runGit(t, work, "push", bare, "pr-1")
+
+	bk := BranchKey{PullRequestNumber: 1, PipelineCounter: 1}
+	base := c.GetBaseHead()
+	c.CreateBranch(bk, base)
+	require.Equal(t, MergeStaleHead, c.MergeBranch(bk, prs))
+	bv := c.GetBranch(bk)
+	require.False(t, bv.isValid)
+	require.Equal(t, base, bv.CommitID)
+
+	prs[0].Head = CommitID(fake.git.resolve("refs/heads/pr-1"))
+	require.Equal(t, Merged, c.MergeBranch(bk, prs))
+	require.True(t, c.GetBranch(bk).isValid)
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/google/go-github/v36/github"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,35 +19,109 @@ import (
 const perPage = 100
 const mergeConflictStatusCode = 409
 const notFoundStatusCode = 404
+const forbiddenStatusCode = 403
+const unprocessableEntityStatusCode = 422
+
+// freezeBranchPrefix prefixes the name of the branch whose existence freezes
+// the merge queue of a base branch, see SetFrozen.
+const freezeBranchPrefix = "merge-freeze"
 
 // githubClientImpl implements GithubClient using the actual github HTTP REST
 // API, wrapped by the go-github package.
 //
-// The HTTP calls are all synchronous and could obviously be made concurrent but
-// I just haven't bothered doing that yet.
+// The HTTP calls are synchronous, except that fetchPullRequests fetches pull
+// requests concurrently, calling GetPullRequest from up to
+// MaxConcurrentRequests goroutines and within the mergeability timeout. The
+// client is safe for such concurrent use.
 type githubClientImpl struct {
 	*github.Client
-	owner, repo, baseBranchName, token string
+	owner, repo, baseBranchName string
+	cfg                         Config
+	// pollInterval is the time between polls of a pull request while github
+	// determines whether it has merge conflicts.
+	pollInterval time.Duration
+	// ctx is the context of the requests, see WithContext.
+	ctx context.Context
 }
 
 var _ GithubClient = (*githubClientImpl)(nil)
 
-func NewGithubClient(owner, repo, baseBranchName, token string) GithubClient {
+// NewGithubHTTPClient returns an HTTP client for the github API, which
+// authenticates with the given token and waits for the rate limit to be reset
+// once it is exhausted. Several GithubClients can share it, and therefore share
+// the rate limit.
+func NewGithubHTTPClient(token string) *http.Client {
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: token},
 	)
-	tc := oauth2.NewClient(context.Background(), ts)
+	hc := oauth2.NewClient(context.Background(), ts)
+	hc.Transport = &rateLimitTransport{base: hc.Transport}
+	return hc
+}
+
+// NewGithubClient returns a GithubClient for the github API at apiURL, or at
+// the default one if empty, which makes its requests with the given HTTP
+// client, see NewGithubHTTPClient.
+// Any errors will result in a panic.
+func NewGithubClient(hc *http.Client, apiURL, owner, repo, baseBranchName string, cfg Config) GithubClient {
+	var baseURL *url.URL
+	if apiURL != "" {
+		var err error
+		baseURL, err = url.Parse(strings.TrimSuffix(apiURL, "/") + "/")
+		onErrPanic(err)
+	}
+	return newGithubClientImpl(hc, baseURL, owner, repo, baseBranchName, cfg)
+}
+
+// newGithubClientImpl returns a githubClientImpl which makes its requests with
+// the given HTTP client, to the github API at the given base URL or at the
+// default one if nil.
+func newGithubClientImpl(hc *http.Client, baseURL *url.URL, owner, repo, baseBranchName string, cfg Config) *githubClientImpl {
+	// Count the requests in the metrics, and trace them.
+	mhc := *hc
+	mhc.Transport = metricsTransport{base: tracingTransport{base: hc.Transport}}
+	gc := github.NewClient(&mhc)
+	if baseURL != nil {
+		gc.BaseURL = baseURL
+	}
 	return &githubClientImpl{
-		Client:         github.NewClient(tc),
+		Client:         gc,
 		owner:          owner,
 		repo:           repo,
 		baseBranchName: baseBranchName,
-		token:          token,
+		cfg:            cfg,
+		pollInterval:   time.Second,
+	}
+}
+
+// WithContext returns a copy of the client which makes its requests within
+// the given context, except for GetPullRequest which has its own.
+func (c *githubClientImpl) WithContext(ctx context.Context) GithubClient {
+	nc := *c
+	nc.ctx = ctx
+	return &nc
+}
+
+// QueueLabels identifies the merge queue managed by the client in its
+// metrics.
+func (c *githubClientImpl) QueueLabels() (repo, base string) {
+	return c.owner + "/" + c.repo, c.baseBranchName
+}
+
+// branchName returns the name of a merge candidate branch of the merge queue.
+func (c *githubClientImpl) branchName(bk BranchKey) string {
+	return bk.BranchName(c.baseBranchName)
+}
+
+func (c *githubClientImpl) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
 	}
+	return c.ctx
 }
 
 func (c *githubClientImpl) GetBranch(bk BranchKey) BranchValue {
-	b, _, err := c.Repositories.GetBranch(context.Background(), c.owner, c.repo, bk.BranchName())
+	b, _, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.branchName(bk))
 	onErrPanic(err)
 	bv := BranchValue{
 		CommitID:    CommitID(b.GetCommit().GetSHA()),
@@ -52,11 +133,26 @@ func (c *githubClientImpl) GetBranch(bk BranchKey) BranchValue {
 	for i, p := range b.GetCommit().Parents {
 		bv.Parents[i] = CommitID(p.GetSHA())
 	}
-	fromCommit, ok := ParseBranchKey(b.GetCommit().GetCommit().GetMessage())
-	if !ok || fromCommit != bk {
+	ct, ok := ParseCommitMessage(b.GetCommit().GetCommit().GetMessage())
+	if !ok || ct.BranchKey != bk {
 		bv.isValid = false
 		return bv
 	}
+	bv.MergedPullRequests = ct.MergedPullRequests
+	if len(bv.MergedPullRequests) == 0 && len(bv.Parents) == 2 {
+		bv.MergedPullRequests = []MergedPullRequest{{Number: bk.PullRequestNumber, Head: bv.Parents[1]}}
+	}
+	if ct.Onto != "" {
+		bv.Parents = []CommitID{ct.Onto}
+	}
+	bv.IsCheckDone, bv.IsCheckPass = c.getCheckStatus(c.context(), bv.CommitID)
+	return bv
+}
+
+// getCheckStatus aggregates the status of all the check suites for a commit.
+// The checks are done if any suite failed or if all of them completed, and
+// pass if all of them succeeded.
+func (c *githubClientImpl) getCheckStatus(ctx context.Context, sha CommitID) (isCheckDone, isCheckPass bool) {
 	opts := &github.ListCheckSuiteOptions{
 		ListOptions: github.ListOptions{Page: 1, PerPage: perPage},
 	}
@@ -64,7 +160,7 @@ func (c *githubClientImpl) GetBranch(bk BranchKey) BranchValue {
 	flagIncomplete := false
 	flagFailed := false
 	for {
-		suites, resp, err := c.Checks.ListCheckSuitesForRef(context.Background(), c.owner, c.repo, b.GetCommit().GetSHA(), opts)
+		suites, resp, err := c.Checks.ListCheckSuitesForRef(ctx, c.owner, c.repo, string(sha), opts)
 		onErrPanic(err)
 		for _, s := range suites.CheckSuites {
 			flagAtLeastOne = true
@@ -80,85 +176,437 @@ func (c *githubClientImpl) GetBranch(bk BranchKey) BranchValue {
 		opts.Page = resp.NextPage
 	}
 	if flagFailed {
-		bv.IsCheckDone = true
-	} else if flagAtLeastOne && !flagIncomplete {
-		bv.IsCheckDone = true
-		bv.IsCheckPass = true
+		return true, false
 	}
-	return bv
+	return flagAtLeastOne && !flagIncomplete, flagAtLeastOne && !flagIncomplete
 }
 
+// CreateBranch is idempotent: if the branch already exists, for instance
+// because an earlier run was interrupted, it is reset to the specified commit.
 func (c *githubClientImpl) CreateBranch(bk BranchKey, sha CommitID) {
 	ref := &github.Reference{
-		Ref:    github.String("refs/heads/" + bk.BranchName()),
+		Ref:    github.String("refs/heads/" + c.branchName(bk)),
 		Object: &github.GitObject{SHA: github.String(string(sha))},
 	}
-	_, _, err := c.Git.CreateRef(context.Background(), c.owner, c.repo, ref)
+	_, resp, err := c.Git.CreateRef(c.context(), c.owner, c.repo, ref)
+	if err != nil && resp != nil && resp.StatusCode == unprocessableEntityStatusCode {
+		c.resetBranch(bk, sha)
+		return
+	}
 	onErrPanic(err)
 }
 
 func (c *githubClientImpl) DeleteBranch(bk BranchKey) {
-	_, err := c.Git.DeleteRef(context.Background(), c.owner, c.repo, "heads/"+bk.BranchName())
+	_, err := c.Git.DeleteRef(c.context(), c.owner, c.repo, "heads/"+c.branchName(bk))
 	onErrPanic(err)
 }
 
-func (c *githubClientImpl) MergeBranch(bk BranchKey, sha CommitID) bool {
+// MergeBranch is idempotent: if the pull requests were already merged into the
+// branch, for instance by an earlier run which was interrupted, it succeeds
+// without merging them again.
+func (c *githubClientImpl) MergeBranch(bk BranchKey, prs []MergedPullRequest) MergeResult {
+	b, _, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.branchName(bk))
+	onErrPanic(err)
+	if ct, ok := ParseCommitMessage(b.GetCommit().GetCommit().GetMessage()); ok && ct.BranchKey == bk &&
+		reflect.DeepEqual(ct.MergedPullRequests, prs) {
+		return Merged
+	}
+	onto := CommitID(b.GetCommit().GetSHA())
+	ct := CandidateTrailers{BranchKey: bk}
+	if len(prs) > 1 || c.cfg.MergeStrategy == RebaseStrategy {
+		// The commit at which the branch was created is not a parent of the head
+		// when the pull requests are rebased or when there is more than one.
+		ct.Onto = onto
+	}
+	for i, pr := range prs {
+		ct.MergedPullRequests = prs[:i+1]
+		ct.isPartial = i < len(prs)-1
+		result := MergeConflict
+		switch c.cfg.MergeStrategy {
+		case SquashStrategy:
+			if c.squashBranch(ct, pr) {
+				result = Merged
+			}
+		case RebaseStrategy:
+			result = c.rebaseBranch(ct, pr)
+		default:
+			data, author := c.commitMessageData(pr.Number)
+			msg := ct.CommitMessage(c.cfg.CommitMessage(data))
+			if rc, ok := c.merge(bk, pr.Head, msg); ok {
+				if rc == nil {
+					c.commitOnBranch(bk, msg, author)
+				}
+				result = Merged
+			}
+		}
+		if result != Merged {
+			// Leave the branch as it was created, so that it doesn't look like
+			// a merge candidate for a subset of the batch.
+			c.resetBranch(bk, onto)
+			return result
+		}
+	}
+	return Merged
+}
+
+// commitMessageData fetches the data for the commit message template, along
+// with the author of the commits which stand for the pull request, which is
+// its author with their github noreply email address.
+func (c *githubClientImpl) commitMessageData(number PullRequestNumber) (CommitMessageData, *github.CommitAuthor) {
+	pr, _, err := c.PullRequests.Get(c.context(), c.owner, c.repo, int(number))
+	onErrPanic(err)
+	data := CommitMessageData{
+		Number: number,
+		Title:  pr.GetTitle(),
+		Body:   pr.GetBody(),
+		Author: pr.GetUser().GetLogin(),
+	}
+	email := data.Author + "@users.noreply.github.com"
+	if id := pr.GetUser().GetID(); id != 0 {
+		email = fmt.Sprintf("%d+%s", id, email)
+	}
+	author := &github.CommitAuthor{Name: github.String(data.Author), Email: github.String(email)}
+	for login, state := range c.latestReviews(c.context(), number) {
+		if state == "APPROVED" {
+			data.Approvers = append(data.Approvers, login)
+		}
+	}
+	sort.Strings(data.Approvers)
+	return data, author
+}
+
+// latestReviews returns the state of the latest review of each reviewer of a
+// pull request, ignoring plain comments.
+func (c *githubClientImpl) latestReviews(ctx context.Context, number PullRequestNumber) map[string]string {
+	// Reviews are listed in chronological order.
+	latest := map[string]string{}
+	opts := &github.ListOptions{Page: 1, PerPage: perPage}
+	for {
+		reviews, resp, err := c.PullRequests.ListReviews(ctx, c.owner, c.repo, int(number), opts)
+		onErrPanic(err)
+		for _, r := range reviews {
+			if r.GetState() != "COMMENTED" {
+				latest[r.GetUser().GetLogin()] = r.GetState()
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return latest
+}
+
+// merge merges a commit into a merge candidate branch, returning the merge
+// commit, which is nil if there was nothing to merge because the commit was
+// already in the branch. Returns false iff there is a merge conflict.
+func (c *githubClientImpl) merge(bk BranchKey, sha CommitID, msg string) (*github.RepositoryCommit, bool) {
 	req := &github.RepositoryMergeRequest{
-		Base:          github.String(bk.BranchName()),
+		Base:          github.String(c.branchName(bk)),
 		Head:          github.String(string(sha)),
-		CommitMessage: github.String(bk.BranchName()),
+		CommitMessage: github.String(msg),
 	}
-	_, resp, err := c.Repositories.Merge(context.Background(), c.owner, c.repo, req)
+	rc, resp, err := c.Repositories.Merge(c.context(), c.owner, c.repo, req)
 	if err != nil {
 		if resp != nil && resp.StatusCode == mergeConflictStatusCode {
-			return false
+			return nil, false
 		}
 		onErrPanic(err)
 	}
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, true
+	}
+	return rc, true
+}
+
+// commitOnBranch creates a commit with the same tree as the head of a merge
+// candidate branch on top of it, for its message to record the merge
+// candidate trailers when there was nothing to merge.
+func (c *githubClientImpl) commitOnBranch(bk BranchKey, msg string, author *github.CommitAuthor) {
+	b, _, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.branchName(bk))
+	onErrPanic(err)
+	tree := b.GetCommit().GetCommit().GetTree().GetSHA()
+	c.resetBranch(bk, c.createCommit(msg, tree, CommitID(b.GetCommit().GetSHA()), author))
+}
+
+// squashBranch merges the pull request head into the merge candidate branch
+// and then replaces the resulting merge commit by a single-parent commit with
+// the same tree, authored by the author of the pull request.
+func (c *githubClientImpl) squashBranch(ct CandidateTrailers, pr MergedPullRequest) bool {
+	data, author := c.commitMessageData(pr.Number)
+	msg := ct.CommitMessage(c.cfg.CommitMessage(data))
+	rc, ok := c.merge(ct.BranchKey, pr.Head, msg)
+	if !ok {
+		return false
+	}
+	if rc == nil {
+		c.commitOnBranch(ct.BranchKey, msg, author)
+		return true
+	}
+	squashed := c.createCommit(msg, rc.GetCommit().GetTree().GetSHA(), CommitID(rc.Parents[0].GetSHA()), author)
+	c.resetBranch(ct.BranchKey, squashed)
 	return true
 }
 
+// rebaseBranch replays the commits of the pull request on top of the merge
+// candidate branch. The GitHub API has no cherry-pick endpoint, so each commit
+// is cherry-picked by merging it into a temporary commit which has the same
+// tree as the branch head but the original parent of the commit, and then
+// by re-parenting the resulting tree onto the branch head. If the pull request
+// was pushed to since its head was fetched, its commits are no longer those
+// of that head, and nothing gets rebased: the result is MergeStaleHead.
+func (c *githubClientImpl) rebaseBranch(ct CandidateTrailers, pr MergedPullRequest) MergeResult {
+	b, _, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.branchName(ct.BranchKey))
+	onErrPanic(err)
+	head := CommitID(b.GetCommit().GetSHA())
+	tree := b.GetCommit().GetCommit().GetTree().GetSHA()
+	commits := c.listPullRequestCommits(pr.Number)
+	if len(commits) == 0 || CommitID(commits[len(commits)-1].GetSHA()) != pr.Head {
+		return MergeStaleHead
+	}
+	for i, rc := range commits {
+		if len(rc.Parents) != 1 {
+			// Merge commits can't be rebased.
+			return MergeConflict
+		}
+		tmp := c.createCommit("temporary commit", tree, CommitID(rc.Parents[0].GetSHA()), nil)
+		c.resetBranch(ct.BranchKey, tmp)
+		mc, ok := c.merge(ct.BranchKey, CommitID(rc.GetSHA()), c.branchName(ct.BranchKey))
+		if !ok {
+			return MergeConflict
+		}
+		if mc != nil {
+			tree = mc.GetCommit().GetTree().GetSHA()
+		}
+		// The branch may be left at any of these commits if the run gets
+		// interrupted, which mustn't look like merge candidate branches.
+		msg := StripCandidateTrailers(rc.GetCommit().GetMessage())
+		if i == len(commits)-1 {
+			msg = ct.CommitMessage(msg)
+		}
+		head = c.createCommit(msg, tree, head, rc.GetCommit().GetAuthor())
+	}
+	c.resetBranch(ct.BranchKey, head)
+	return Merged
+}
+
+func (c *githubClientImpl) listPullRequestCommits(number PullRequestNumber) []*github.RepositoryCommit {
+	var ret []*github.RepositoryCommit
+	opts := &github.ListOptions{Page: 1, PerPage: perPage}
+	for {
+		commits, resp, err := c.PullRequests.ListCommits(c.context(), c.owner, c.repo, int(number), opts)
+		onErrPanic(err)
+		ret = append(ret, commits...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return ret
+}
+
+func (c *githubClientImpl) createCommit(msg, tree string, parent CommitID, author *github.CommitAuthor) CommitID {
+	commit := &github.Commit{
+		Message: github.String(msg),
+		Tree:    &github.Tree{SHA: github.String(tree)},
+		Parents: []*github.Commit{{SHA: github.String(string(parent))}},
+		Author:  author,
+	}
+	created, _, err := c.Git.CreateCommit(c.context(), c.owner, c.repo, commit)
+	onErrPanic(err)
+	return CommitID(created.GetSHA())
+}
+
+func (c *githubClientImpl) resetBranch(bk BranchKey, sha CommitID) {
+	ref := &github.Reference{
+		Ref:    github.String("refs/heads/" + c.branchName(bk)),
+		Object: &github.GitObject{SHA: github.String(string(sha))},
+	}
+	_, _, err := c.Git.UpdateRef(c.context(), c.owner, c.repo, ref, true)
+	onErrPanic(err)
+}
+
+func (c *githubClientImpl) Now() time.Time {
+	return time.Now()
+}
+
 func (c *githubClientImpl) GetBaseHead() CommitID {
-	base, _, err := c.Repositories.GetBranch(context.Background(), c.owner, c.repo, c.baseBranchName)
+	base, _, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.baseBranchName)
 	onErrPanic(err)
 	return CommitID(base.GetCommit().GetSHA())
 }
 
-func (c *githubClientImpl) FastForwardBase(sha CommitID) {
+func (c *githubClientImpl) FastForwardBase(old, sha CommitID) bool {
+	if c.GetBaseHead() != old {
+		return false
+	}
 	ref := &github.Reference{
 		Ref:    github.String("refs/heads/" + c.baseBranchName),
 		Object: &github.GitObject{SHA: github.String(string(sha))},
 	}
-	_, _, err := c.Git.UpdateRef(context.Background(), c.owner, c.repo, ref, false)
+	// The update fails unless it's a fast-forward, which it isn't if the base
+	// branch was pushed to since it was checked above. It may also be rejected
+	// for good, by a branch protection rule for instance, which is an error.
+	_, resp, err := c.Git.UpdateRef(c.context(), c.owner, c.repo, ref, false)
+	if err != nil && resp != nil && resp.StatusCode == unprocessableEntityStatusCode && c.GetBaseHead() != old {
+		return false
+	}
 	onErrPanic(err)
+	return true
 }
 
-func (c *githubClientImpl) GetMergeablePullRequestHead(number PullRequestNumber) *CommitID {
-	for {
-		pr, resp, err := c.PullRequests.Get(context.Background(), c.owner, c.repo, int(number))
+// freezeBranchName returns the name of the branch which freezes the merge
+// queue.
+func (c *githubClientImpl) freezeBranchName() string {
+	return freezeBranchPrefix + "/" + c.baseBranchName
+}
+
+func (c *githubClientImpl) IsFrozen() bool {
+	_, resp, err := c.Repositories.GetBranch(c.context(), c.owner, c.repo, c.freezeBranchName())
+	if err != nil && resp != nil && resp.StatusCode == notFoundStatusCode {
+		return false
+	}
+	onErrPanic(err)
+	return true
+}
+
+// SetFrozen persists the freeze in the repo as a branch, which points at the
+// head of the base branch when the merge queue got frozen. It is idempotent.
+func (c *githubClientImpl) SetFrozen(frozen bool) {
+	if !frozen {
+		resp, err := c.Git.DeleteRef(c.context(), c.owner, c.repo, "heads/"+c.freezeBranchName())
+		if err != nil && resp != nil && resp.StatusCode == unprocessableEntityStatusCode {
+			return
+		}
+		onErrPanic(err)
+		return
+	}
+	ref := &github.Reference{
+		Ref:    github.String("refs/heads/" + c.freezeBranchName()),
+		Object: &github.GitObject{SHA: github.String(string(c.GetBaseHead()))},
+	}
+	_, resp, err := c.Git.CreateRef(c.context(), c.owner, c.repo, ref)
+	if err != nil && resp != nil && resp.StatusCode == unprocessableEntityStatusCode {
+		return
+	}
+	onErrPanic(err)
+}
+
+func (c *githubClientImpl) GetPullRequest(ctx context.Context, number PullRequestNumber) (ret *PullRequest) {
+	defer func() {
+		// The reviews, check suites and files are fetched within the context
+		// too, so the pull request is pending if it gets done in the meantime.
+		if r := recover(); r != nil {
+			if ctx.Err() == nil {
+				panic(r)
+			}
+			ret = &PullRequest{Number: number, IsMergeabilityPending: true}
+		}
+	}()
+	for retries := 0; ; retries++ {
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Int("github.retries", retries))
+		pr, resp, err := c.PullRequests.Get(ctx, c.owner, c.repo, int(number))
 		if err != nil {
 			if resp != nil && resp.StatusCode == notFoundStatusCode {
 				return nil
 			}
+			if ctx.Err() != nil {
+				return &PullRequest{Number: number, IsMergeabilityPending: true}
+			}
 			onErrPanic(err)
 		}
-		if pr.GetState() != "open" || pr.GetLocked() || pr.GetDraft() {
-			return nil
+		ret = &PullRequest{
+			Number:   number,
+			Head:     CommitID(pr.GetHead().GetSHA()),
+			IsOpen:   pr.GetState() == "open",
+			IsLocked: pr.GetLocked(),
+			IsDraft:  pr.GetDraft(),
+			Author:   pr.GetUser().GetLogin(),
+		}
+		if ref := pr.GetBase().GetRef(); ref != "" && ref != c.baseBranchName && ret.IsOpen {
+			var isPending bool
+			if ret.StackedOn, isPending = c.pullRequestWithHead(ctx, ref); isPending {
+				return &PullRequest{Number: number, IsMergeabilityPending: true}
+			}
+			ret.IsForOtherBase = ret.StackedOn == 0
+		}
+		if !ret.IsOpen || ret.IsLocked || ret.IsDraft || ret.IsForOtherBase {
+			return ret
 		}
 		if pr.Mergeable == nil {
 			// Wait for github to determine if PR can be merged or not.
-			time.Sleep(time.Second)
-			continue
+			select {
+			case <-ctx.Done():
+				ret.IsMergeabilityPending = true
+				return ret
+			case <-time.After(c.pollInterval):
+				continue
+			}
+		}
+		ret.HasConflicts = !pr.GetMergeable()
+		for _, label := range pr.Labels {
+			ret.Labels = append(ret.Labels, label.GetName())
+		}
+		rules := c.cfg.MergeRules
+		if rules.RequiredApprovals > 0 || rules.BlockOnChangesRequested {
+			for _, state := range c.latestReviews(ctx, number) {
+				switch state {
+				case "APPROVED":
+					ret.Approvals++
+				case "CHANGES_REQUESTED":
+					ret.IsChangesRequested = true
+				}
+			}
 		}
-		if !pr.GetMergeable() {
-			return nil
+		if rules.RequirePassingChecks {
+			ret.IsCheckDone, ret.IsCheckPass = c.getCheckStatus(ctx, ret.Head)
 		}
-		ret := CommitID(pr.GetHead().GetSHA())
-		return &ret
+		if c.cfg.FairShare.usesPaths() {
+			ret.Files = c.listFiles(ctx, number)
+		}
+		return ret
 	}
 }
 
-func (c *githubClientImpl) ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg string)) {
+// listFiles returns the paths of the files changed by a pull request.
+func (c *githubClientImpl) listFiles(ctx context.Context, number PullRequestNumber) []string {
+	var files []string
+	opts := &github.ListOptions{Page: 1, PerPage: perPage}
+	for {
+		commitFiles, resp, err := c.PullRequests.ListFiles(ctx, c.owner, c.repo, int(number), opts)
+		onErrPanic(err)
+		for _, f := range commitFiles {
+			files = append(files, f.GetFilename())
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return files
+}
+
+// pullRequestWithHead returns the number of the open pull request whose head
+// is the given branch of the repo, 0 if there is none. It is pending instead if
+// the context is done before github responds.
+func (c *githubClientImpl) pullRequestWithHead(ctx context.Context, branch string) (number PullRequestNumber, isPending bool) {
+	opts := &github.PullRequestListOptions{
+		State:       "open",
+		Head:        c.owner + ":" + branch,
+		ListOptions: github.ListOptions{PerPage: 1},
+	}
+	prs, _, err := c.PullRequests.List(ctx, c.owner, c.repo, opts)
+	if err != nil && ctx.Err() != nil {
+		return 0, true
+	}
+	onErrPanic(err)
+	if len(prs) == 0 {
+		return 0, false
+	}
+	return PullRequestNumber(prs[0].GetNumber()), false
+}
+
+func (c *githubClientImpl) ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg, author string, createdAt time.Time)) {
 	since := time.Now().Add(-duration)
 	opts := &github.IssueListCommentsOptions{
 		Sort:        github.String("created"),
@@ -167,31 +615,43 @@ func (c *githubClientImpl) ListAllCommentsSince(duration time.Duration, fn func(
 		ListOptions: github.ListOptions{Page: 1, PerPage: perPage},
 	}
 	for {
-		comments, resp, err := c.Issues.ListComments(context.Background(), c.owner, c.repo, 0, opts)
+		comments, resp, err := c.Issues.ListComments(c.context(), c.owner, c.repo, 0, opts)
 		onErrPanic(err)
 		for _, comment := range comments {
 			components := strings.Split(comment.GetIssueURL(), "/")
 			num, err := strconv.Atoi(components[len(components)-1])
 			onErrPanic(err)
-			fn(PullRequestNumber(num), comment.GetBody())
+			fn(PullRequestNumber(num), comment.GetBody(), comment.GetUser().GetLogin(), comment.GetCreatedAt())
 		}
 		if resp.NextPage == 0 {
 			break
 		}
-		opts.Page++
+		opts.Page = resp.NextPage
 	}
 }
 
+func (c *githubClientImpl) IsMaintainer(login string) bool {
+	level, resp, err := c.Repositories.GetPermissionLevel(c.context(), c.owner, c.repo, login)
+	if err != nil && resp != nil && resp.StatusCode == notFoundStatusCode {
+		return false
+	}
+	onErrPanic(err)
+	// The maintain permission is reported as write, except in the permissions
+	// of the user.
+	return level.GetPermission() == "admin" || level.GetUser().GetPermissions()["maintain"]
+}
+
 func (c *githubClientImpl) ListAllMergeCandidateBranches(fn func(bk BranchKey)) {
 	opts := &github.BranchListOptions{
 		ListOptions: github.ListOptions{Page: 1, PerPage: perPage},
 	}
 	for {
-		results, resp, err := c.Repositories.ListBranches(context.Background(), c.owner, c.repo, opts)
+		results, resp, err := c.Repositories.ListBranches(c.context(), c.owner, c.repo, opts)
 		onErrPanic(err)
 		for _, result := range results {
-			bk, ok := ParseBranchKey(result.GetName())
-			if ok {
+			// Skip the branches of the merge queues of other base branches.
+			base, bk, _, ok := ParseBranchName(result.GetName())
+			if ok && base == c.baseBranchName {
 				fn(bk)
 			}
 		}
@@ -202,6 +662,161 @@ func (c *githubClientImpl) ListAllMergeCandidateBranches(fn func(bk BranchKey))
 	}
 }
 
+// MigrateLegacyBranches renames the merge candidate branches with legacy names,
+// created by earlier versions for the pull requests which target the base
+// branch, and returns their keys. The branches of pull requests which target
+// other base branches are left for the merge queues of these.
+func (c *githubClientImpl) MigrateLegacyBranches() []BranchKey {
+	legacy := map[BranchKey]CommitID{}
+	exists := map[string]struct{}{}
+	opts := &github.BranchListOptions{
+		ListOptions: github.ListOptions{Page: 1, PerPage: perPage},
+	}
+	for {
+		results, resp, err := c.Repositories.ListBranches(c.context(), c.owner, c.repo, opts)
+		onErrPanic(err)
+		for _, result := range results {
+			exists[result.GetName()] = struct{}{}
+			if _, bk, isLegacy, _ := ParseBranchName(result.GetName()); isLegacy {
+				legacy[bk] = CommitID(result.GetCommit().GetSHA())
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	var migrated []BranchKey
+	for bk, sha := range legacy {
+		pr, resp, err := c.PullRequests.Get(c.context(), c.owner, c.repo, int(bk.PullRequestNumber))
+		if err != nil && resp != nil && resp.StatusCode == notFoundStatusCode {
+			continue
+		}
+		onErrPanic(err)
+		if pr.GetBase().GetRef() != c.baseBranchName {
+			continue
+		}
+		// The branch may have been created before an earlier migration
+		// got interrupted.
+		if _, ok := exists[c.branchName(bk)]; !ok {
+			c.CreateBranch(bk, sha)
+		}
+		_, err = c.Git.DeleteRef(c.context(), c.owner, c.repo, "heads/"+bk.LegacyBranchName())
+		onErrPanic(err)
+		migrated = append(migrated, bk)
+	}
+	sort.Slice(migrated, func(i, j int) bool { return migrated[i].Less(migrated[j]) })
+	return migrated
+}
+
+// GetDependencyStatus considers a dependency to be cancelled if it was closed
+// without being merged, or if its merge was cancelled, and to have failed if
+// the check suites failed on all of the merge candidate branches of the merge
+// queue of its base branch which it is merged into. Dependencies are named by
+// pull request authors, so one which can't be found or accessed is invalid
+// rather than an error.
+func (c *githubClientImpl) GetDependencyStatus(ref PullRequestRef) DependencyStatus {
+	parts := strings.SplitN(ref.Repo, "/", 2)
+	pr, resp, err := c.PullRequests.Get(c.context(), parts[0], parts[1], int(ref.Number))
+	if err != nil && resp != nil && (resp.StatusCode == notFoundStatusCode || resp.StatusCode == forbiddenStatusCode) {
+		return DependencyInvalid
+	}
+	onErrPanic(err)
+	switch {
+	case pr.GetMerged():
+		return DependencyMerged
+	case pr.GetState() == "closed":
+		return DependencyCancelled
+	}
+	dc := c.forQueue(parts[0], parts[1], pr.GetBase().GetRef())
+	if dc.isMergeCancelled(ref.Number) {
+		return DependencyCancelled
+	}
+	numFailed, numOthers := 0, 0
+	dc.ListAllMergeCandidateBranches(func(bk BranchKey) {
+		bv := dc.GetBranch(bk)
+		for _, number := range bv.PullRequestNumbers(bk) {
+			if number != ref.Number {
+				continue
+			}
+			if bv.IsCheckDone && !bv.IsCheckPass {
+				numFailed++
+			} else {
+				numOthers++
+			}
+		}
+	})
+	if numFailed > 0 && numOthers == 0 {
+		return DependencyFailed
+	}
+	return DependencyPending
+}
+
+// forQueue returns a copy of the client for the merge queue of a base branch
+// in any repo.
+func (c *githubClientImpl) forQueue(owner, repo, baseBranchName string) *githubClientImpl {
+	nc := *c
+	nc.owner, nc.repo, nc.baseBranchName = owner, repo, baseBranchName
+	return &nc
+}
+
+// isMergeCancelled returns true iff the latest order in the comments on the
+// pull request with the given number cancelled its merge, see
+// ToDecoratedWithPullRequests.
+func (c *githubClientImpl) isMergeCancelled(number PullRequestNumber) bool {
+	isCancelled := false
+	opts := &github.IssueListCommentsOptions{
+		ListOptions: github.ListOptions{Page: 1, PerPage: perPage},
+	}
+	for {
+		comments, resp, err := c.Issues.ListComments(c.context(), c.owner, c.repo, int(number), opts)
+		onErrPanic(err)
+		for _, comment := range comments {
+			for _, line := range strings.Split(comment.GetBody(), "\n") {
+				if borsMergeRe.MatchString(line) {
+					isCancelled = false
+				}
+				if borsCancelRe.MatchString(line) {
+					isCancelled = true
+				}
+				if m := noticeMarkerRe.FindStringSubmatch(line); m != nil && m[1] == approvalRevokedNotice {
+					isCancelled = true
+				}
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return isCancelled
+}
+
+// legacyBranchMigrator is implemented by GithubClients which can rename the
+// merge candidate branches created by earlier versions.
+type legacyBranchMigrator interface {
+	MigrateLegacyBranches() []BranchKey
+}
+
+// MigrateLegacyBranches renames the merge candidate branches created by
+// earlier versions, if the client supports it, and logs them. It is meant to
+// be called once on startup, before running the state machine.
+func MigrateLegacyBranches(c GithubClient, log *Logger) {
+	m, ok := c.(legacyBranchMigrator)
+	if !ok {
+		return
+	}
+	for _, bk := range m.MigrateLegacyBranches() {
+		log.Log("migrated legacy branch", "branch", bk.LegacyBranchName())
+	}
+}
+
+func (c *githubClientImpl) PostComment(number PullRequestNumber, msg string) {
+	comment := &github.IssueComment{Body: github.String(msg)}
+	_, _, err := c.Issues.CreateComment(c.context(), c.owner, c.repo, int(number), comment)
+	onErrPanic(err)
+}
+
 func onErrPanic(err error) {
 	if err != nil {
 		panic(err)
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// The tests below run githubClientImpl against github API responses replayed
+// from the cassettes in testdata/cassettes. Running them with the -record flag
+// records the cassettes against an actual repo instead, which needs to be in
+// the state each test expects.
+
+func TestGithubClientListAllCommentsSince(t *testing.T) {
+	c := newCassetteClient(t, "list_comments", DefaultConfig())
+	var actual []TestComment
+	c.ListAllCommentsSince(time.Hour, func(number PullRequestNumber, msg, author string, _ time.Time) {
+		actual = append(actual, TestComment{PullRequestNumber: number, msg: msg, author: author})
+	})
+	require.Equal(t, []TestComment{
+		{PullRequestNumber: 1, msg: "bors merge", author: "alice"},
+		{PullRequestNumber: 2, msg: "bors merge", author: "bob"},
+		{PullRequestNumber: 1, msg: "bors cancel", author: "alice"},
+	}, actual)
+}
+
+func TestGithubClientListAllMergeCandidateBranches(t *testing.T) {
+	c := newCassetteClient(t, "list_branches", DefaultConfig())
+	var actual []BranchKey
+	c.ListAllMergeCandidateBranches(func(bk BranchKey) {
+		actual = append(actual, bk)
+	})
+	require.Equal(t, []BranchKey{
+		{PullRequestNumber: 1, PipelineCounter: 1},
+		{PullRequestNumber: 2, PipelineCounter: 3},
+	}, actual)
+}
+
+func TestGithubClientGetBranch(t *testing.T) {
+	c := newCassetteClient(t, "get_branch", DefaultConfig())
+
+	// Some check suites are still running.
+	bv := c.GetBranch(BranchKey{PullRequestNumber: 1, PipelineCounter: 1})
+	require.Equal(t, BranchValue{
+		CommitID:           "c1",
+		Parents:            []CommitID{"base", "pr1"},
+		MergedPullRequests: []MergedPullRequest{{Number: 1, Head: "pr1"}},
+		isValid:            true,
+	}, bv)
+
+	// A check suite failed, the remaining ones don't matter.
+	bv = c.GetBranch(BranchKey{PullRequestNumber: 2, PipelineCounter: 1})
+	require.Equal(t, BranchValue{
+		CommitID:           "c2",
+		Parents:            []CommitID{"base"},
+		MergedPullRequests: []MergedPullRequest{{Number: 2, Head: "pr2"}, {Number: 3, Head: "pr3"}},
+		isValid:            true,
+		IsCheckDone:        true,
+		IsCheckPass:        false,
+	}, bv)
+
+	// Nothing was merged into the branch.
+	bv = c.GetBranch(BranchKey{PullRequestNumber: 4, PipelineCounter: 1})
+	require.Equal(t, BranchValue{
+		CommitID: "base",
+		Parents:  []CommitID{"before-base"},
+	}, bv)
+}
+
+func TestGithubClientGetPullRequest(t *testing.T) {
+	c := newCassetteClient(t, "get_pull_request", DefaultConfig())
+	ctx := context.Background()
+
+	require.Nil(t, c.GetPullRequest(ctx, 404))
+
+	// The mergeability is null in the first response.
+	require.Equal(t, &PullRequest{
+		Number: 1,
+		Head:   "pr1",
+		IsOpen: true,
+		Labels: []string{"lgtm"},
+		Author: "alice",
+	}, c.GetPullRequest(ctx, 1))
+
+	require.Equal(t, &PullRequest{
+		Number:       2,
+		Head:         "pr2",
+		IsOpen:       true,
+		HasConflicts: true,
+		Author:       "alice",
+	}, c.GetPullRequest(ctx, 2))
+
+	// The mergeability of closed pull requests doesn't matter.
+	require.Equal(t, &PullRequest{
+		Number: 3,
+		Head:   "pr3",
+		Author: "alice",
+	}, c.GetPullRequest(ctx, 3))
+
+	// The context is done before github responds.
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, &PullRequest{
+		Number:                5,
+		IsMergeabilityPending: true,
+	}, c.GetPullRequest(done, 5))
+}
+
+// TestGithubClientGetPullRequestError checks that an error while fetching pull
+// requests concurrently panics in the calling goroutine, where the daemon
+// recovers from it, rather than in the one which fetched the pull request.
+func TestGithubClientGetPullRequestError(t *testing.T) {
+	cfg := DefaultConfig()
+	c := newCassetteClient(t, "get_pull_request_error", cfg)
+	require.Panics(t, func() { fetchPullRequests(c, cfg, []PullRequestNumber{1}) })
+}
+
+// TestGithubClientPullRequestWithHeadCancelled checks that the pull request
+// which another one is stacked on is pending if the context is done before
+// github responds, as GetPullRequest is then.
+func TestGithubClientPullRequestWithHeadCancelled(t *testing.T) {
+	c := newCassetteClient(t, "list_pull_requests_cancelled", DefaultConfig())
+	done, cancel := context.WithCancel(context.Background())
+	cancel()
+	number, isPending := c.pullRequestWithHead(done, "feature")
+	require.True(t, isPending)
+	require.Zero(t, number)
+}
+
+func TestGithubClientGetPullRequestWithMergeRules(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MergeRules = MergeRules{
+		RequiredApprovals:       1,
+		BlockOnChangesRequested: true,
+		RequirePassingChecks:    true,
+	}
+	c := newCassetteClient(t, "get_pull_request_rules", cfg)
+	require.Equal(t, &PullRequest{
+		Number:             1,
+		Head:               "pr1",
+		IsOpen:             true,
+		Approvals:          2,
+		IsChangesRequested: true,
+		IsCheckDone:        true,
+		IsCheckPass:        true,
+		Author:             "alice",
+	}, c.GetPullRequest(context.Background(), 1))
+}
+
+// TestGithubClientGetPullRequestFiles checks that the files changed by pull
+// requests are only listed when the fair share groups match paths.
+func TestGithubClientGetPullRequestFiles(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FairShare.Groups = []FairShareGroup{{Name: "docs", Paths: []string{"/docs/"}}}
+	c := newCassetteClient(t, "get_pull_request_files", cfg)
+	require.Equal(t, &PullRequest{
+		Number: 1,
+		Head:   "pr1",
+		IsOpen: true,
+		Author: "alice",
+		Files:  []string{"README.md", "docs/guide.md"},
+	}, c.GetPullRequest(context.Background(), 1))
+}
+
+// TestGithubClientGetDependencyStatusInvalid checks that dependencies which
+// don't exist or aren't accessible are invalid, rather than errors.
+func TestGithubClientGetDependencyStatusInvalid(t *testing.T) {
+	c := newCassetteClient(t, "get_dependency_status_invalid", DefaultConfig())
+	require.Equal(t, DependencyInvalid, c.GetDependencyStatus(PullRequestRef{Repo: "org/lib", Number: 404}))
+	require.Equal(t, DependencyInvalid, c.GetDependencyStatus(PullRequestRef{Repo: "org/private", Number: 3}))
+}
+
+func TestGithubClientMergeBranch(t *testing.T) {
+	c := newCassetteClient(t, "merge_branch", DefaultConfig())
+	bk := BranchKey{PullRequestNumber: 1, PipelineCounter: 1}
+	require.Equal(t, Merged, c.MergeBranch(bk, []MergedPullRequest{{Number: 1, Head: "pr1"}}))
+}
+
+func TestGithubClientMergeBranchConflict(t *testing.T) {
+	c := newCassetteClient(t, "merge_branch_conflict", DefaultConfig())
+	bk := BranchKey{PullRequestNumber: 1, PipelineCounter: 1}
+	require.Equal(t, MergeConflict, c.MergeBranch(bk, []MergedPullRequest{{Number: 1, Head: "pr1"}}))
+}
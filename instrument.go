@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// instrumentedGithubClient wraps a GithubClient to log the changes to the
+// merge candidate branches during a run of the state machine, to count them
+// in the metrics, and to trace the github API calls.
+type instrumentedGithubClient struct {
+	GithubClient
+	log *Logger
+	// base is the base branch of the merge queue, which names its branches.
+	base    string
+	metrics queueMetrics
+	// merged is the set of merge candidate branches which the base branch was
+	// fast-forwarded through, whose deletion is not a waste.
+	merged map[BranchKey]struct{}
+	// ctx holds the current span, see startSpan.
+	ctx context.Context
+}
+
+var _ GithubClient = (*instrumentedGithubClient)(nil)
+
+// contextualGithubClient is implemented by GithubClients which can make their
+// github API calls within a given context, for these to be traced.
+type contextualGithubClient interface {
+	WithContext(ctx context.Context) GithubClient
+}
+
+func newInstrumentedGithubClient(c GithubClient, log *Logger) *instrumentedGithubClient {
+	repo, base := queueLabelsFor(c)
+	return &instrumentedGithubClient{
+		GithubClient: c,
+		log:          log,
+		base:         base,
+		metrics:      newQueueMetrics(repo, base),
+		merged:       map[BranchKey]struct{}{},
+		ctx:          context.Background(),
+	}
+}
+
+// QueueLabels identifies the merge queue of the wrapped GithubClient.
+func (c *instrumentedGithubClient) QueueLabels() (repo, base string) {
+	return queueLabelsFor(c.GithubClient)
+}
+
+// startSpan starts a span, as a child of the current one, which becomes the
+// current span until the returned function ends it. The returned function
+// must be deferred, for a panic to be recorded in the span.
+func (c *instrumentedGithubClient) startSpan(name string, attrs ...attribute.KeyValue) func() {
+	parent := c.ctx
+	ctx, span := tracer.Start(parent, name, trace.WithAttributes(attrs...))
+	c.ctx = ctx
+	return func() {
+		c.ctx = parent
+		if r := recover(); r != nil {
+			span.RecordError(fmt.Errorf("%v", r))
+			span.SetStatus(codes.Error, fmt.Sprint(r))
+			span.End()
+			panic(r)
+		}
+		span.End()
+	}
+}
+
+// traced calls fn within a span, as for startSpan.
+func (c *instrumentedGithubClient) traced(name string, fn func()) {
+	defer c.startSpan(name)()
+	fn()
+}
+
+// startCall starts the span of a github API call, as a child of the current
+// span, and returns the wrapped client which makes the call within it.
+func (c *instrumentedGithubClient) startCall(method string, attrs ...attribute.KeyValue) (GithubClient, trace.Span) {
+	ctx, span := tracer.Start(c.ctx, "github."+method, trace.WithAttributes(attrs...))
+	if cc, ok := c.GithubClient.(contextualGithubClient); ok {
+		return cc.WithContext(ctx), span
+	}
+	return c.GithubClient, span
+}
+
+func (c *instrumentedGithubClient) GetBranch(bk BranchKey) BranchValue {
+	gc, span := c.startCall("GetBranch", branchAttribute(bk.BranchName(c.base)))
+	defer endSpan(span)
+	return gc.GetBranch(bk)
+}
+
+func (c *instrumentedGithubClient) CreateBranch(bk BranchKey, sha CommitID) {
+	gc, span := c.startCall("CreateBranch", branchAttribute(bk.BranchName(c.base)))
+	defer endSpan(span)
+	gc.CreateBranch(bk, sha)
+	c.log.Log("created branch", "branch", bk.BranchName(c.base), "commit", sha)
+	c.metrics.branchesCreated.Inc()
+}
+
+func (c *instrumentedGithubClient) DeleteBranch(bk BranchKey) {
+	gc, span := c.startCall("DeleteBranch", branchAttribute(bk.BranchName(c.base)))
+	defer endSpan(span)
+	gc.DeleteBranch(bk)
+	if _, ok := c.merged[bk]; !ok {
+		c.metrics.branchesWasted.Inc()
+	}
+}
+
+func (c *instrumentedGithubClient) MergeBranch(bk BranchKey, prs []MergedPullRequest) MergeResult {
+	gc, span := c.startCall("MergeBranch", branchAttribute(bk.BranchName(c.base)))
+	defer endSpan(span)
+	result := gc.MergeBranch(bk, prs)
+	numbers := make([]PullRequestNumber, len(prs))
+	for i, pr := range prs {
+		numbers[i] = pr.Number
+	}
+	span.SetAttributes(attribute.String("github.merge_result", string(result)))
+	c.log.Log("merged pull requests into branch", "branch", bk.BranchName(c.base), "prs", numbers, "result", result)
+	return result
+}
+
+func (c *instrumentedGithubClient) GetBaseHead() CommitID {
+	gc, span := c.startCall("GetBaseHead")
+	defer endSpan(span)
+	return gc.GetBaseHead()
+}
+
+func (c *instrumentedGithubClient) IsFrozen() bool {
+	gc, span := c.startCall("IsFrozen")
+	defer endSpan(span)
+	return gc.IsFrozen()
+}
+
+func (c *instrumentedGithubClient) SetFrozen(frozen bool) {
+	gc, span := c.startCall("SetFrozen", attribute.Bool("github.frozen", frozen))
+	defer endSpan(span)
+	gc.SetFrozen(frozen)
+	c.log.Log("set merge queue freeze", "frozen", frozen)
+}
+
+func (c *instrumentedGithubClient) FastForwardBase(old, sha CommitID) bool {
+	gc, span := c.startCall("FastForwardBase", attribute.String("github.commit", string(sha)))
+	defer endSpan(span)
+	return gc.FastForwardBase(old, sha)
+}
+
+// GetPullRequest may be called concurrently, its span is a child of the
+// current span but the call is made within the given context.
+func (c *instrumentedGithubClient) GetPullRequest(ctx context.Context, number PullRequestNumber) *PullRequest {
+	gc, span := c.startCall("GetPullRequest", pullRequestAttribute(number))
+	defer endSpan(span)
+	return gc.GetPullRequest(trace.ContextWithSpan(ctx, span), number)
+}
+
+func (c *instrumentedGithubClient) ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg, author string, createdAt time.Time)) {
+	gc, span := c.startCall("ListAllCommentsSince")
+	defer endSpan(span)
+	gc.ListAllCommentsSince(duration, fn)
+}
+
+func (c *instrumentedGithubClient) IsMaintainer(login string) bool {
+	gc, span := c.startCall("IsMaintainer", attribute.String("github.user", login))
+	defer endSpan(span)
+	return gc.IsMaintainer(login)
+}
+
+func (c *instrumentedGithubClient) ListAllMergeCandidateBranches(fn func(bk BranchKey)) {
+	gc, span := c.startCall("ListAllMergeCandidateBranches")
+	defer endSpan(span)
+	gc.ListAllMergeCandidateBranches(fn)
+}
+
+func (c *instrumentedGithubClient) PostComment(number PullRequestNumber, msg string) {
+	gc, span := c.startCall("PostComment", pullRequestAttribute(number))
+	defer endSpan(span)
+	gc.PostComment(number, msg)
+}
+
+func (c *instrumentedGithubClient) GetDependencyStatus(ref PullRequestRef) DependencyStatus {
+	gc, span := c.startCall("GetDependencyStatus", attribute.String("github.dependency", ref.String()))
+	defer endSpan(span)
+	status := gc.GetDependencyStatus(ref)
+	span.SetAttributes(attribute.String("github.dependency_status", string(status)))
+	return status
+}
+
+// fastForwardBase fast-forwards the base branch to the given commit, then logs
+// the path taken through the pipeline tree and updates the metrics. If the
+// base branch was pushed to since the state was fetched, the conflict is
+// logged and counted instead, for the state to be fetched again. Returns true
+// iff the base branch was fast-forwarded.
+func (c *instrumentedGithubClient) fastForwardBase(s State, t PipelineTree, sha CommitID) bool {
+	path := s.FastForwardPath(t, sha)
+	if !c.FastForwardBase(s.Base, sha) {
+		c.log.Log("fast-forward conflict", "base", s.Base, "target", sha, "path", branchNames(c.base, path))
+		c.metrics.fastForwardConflicts.Inc()
+		return false
+	}
+	c.log.Log("fast-forward", "base", s.Base, "target", sha, "path", branchNames(c.base, path))
+	c.metrics.fastForwards.Inc()
+	now := c.Now()
+	for _, bk := range path {
+		c.merged[bk] = struct{}{}
+		for _, number := range s.Branches[bk].PullRequestNumbers(bk) {
+			if approvedAt, ok := s.ApprovalTimes[number]; ok {
+				c.metrics.timeToMerge.Observe(now.Sub(approvedAt).Seconds())
+			}
+		}
+	}
+	return true
+}
+
+// holdFastForward notifies the pull requests which the freeze of the base
+// branch holds back, see NotifyFrozenPullRequests, and logs them.
+func (c *instrumentedGithubClient) holdFastForward(s State, t PipelineTree) {
+	if held := s.NotifyFrozenPullRequests(c, t); len(held) > 0 {
+		c.log.Log("fast-forward held by freeze", "base", s.Base, "reason", s.Freeze, "prs", held)
+	}
+}
+
+// rebuildPipeline transitions the state to another in which the build
+// pipeline has been rebuilt off of the head of the base branch, which was
+// pushed to outside of the merge queue, see ToRebuiltPipeline.
+func (c *instrumentedGithubClient) rebuildPipeline(s State, previousBase CommitID) State {
+	c.log.Log("base branch pushed outside of the merge queue", "base", s.Base, "previous_base", previousBase)
+	c.metrics.externalBasePushes.Inc()
+	ns := s.ToRebuiltPipeline(c, previousBase)
+	c.log.Log("rebuilt pipeline", "branches", branchNames(c.base, ns.sortedBranchKeys()))
+	return ns
+}
+
+// logPruned logs the merge candidate branches which got pruned in the
+// transition from one state to the other, with the reason why. Returns the
+// latter state.
+func (c *instrumentedGithubClient) logPruned(before, after State, reason func(s State, bk BranchKey) string) State {
+	for _, bk := range before.sortedBranchKeys() {
+		if _, ok := after.Branches[bk]; !ok {
+			c.log.Log("pruned branch", "branch", bk.BranchName(c.base), "reason", reason(before, bk))
+		}
+	}
+	return after
+}
+
+// incompleteReason returns why a merge candidate branch gets pruned by
+// ToRecoveredBranches.
+func incompleteReason(_ State, _ BranchKey) string {
+	return "incomplete"
+}
+
+// staleReason returns why a merge candidate branch gets pruned by
+// ToPrunedStalePullRequests.
+func staleReason(s State, bk BranchKey) string {
+	for _, pr := range s.Branches[bk].MergedPullRequests {
+		if head, ok := s.MergeablePullRequests[pr.Number]; ok && head != pr.Head {
+			return fmt.Sprintf("head of #%d changed from %s to %s", pr.Number, pr.Head, head)
+		}
+	}
+	return "stale"
+}
+
+// cancelledReason returns why a merge candidate branch gets pruned by
+// ToPrunedCancelledPullRequests.
+func cancelledReason(s State, bk BranchKey) string {
+	for _, number := range s.Branches[bk].PullRequestNumbers(bk) {
+		if _, ok := s.CancelledPullRequests[number]; ok {
+			return fmt.Sprintf("#%d cancelled", number)
+		}
+		if reason, ok := s.BlockedPullRequests[number]; ok {
+			return fmt.Sprintf("#%d blocked because %s", number, reason)
+		}
+	}
+	return "cancelled"
+}
+
+// orphanedReason returns why a merge candidate branch gets pruned by
+// ToPrunedOrphanedBranches.
+func (c *instrumentedGithubClient) orphanedReason(_ State, bk BranchKey) string {
+	if _, ok := c.merged[bk]; ok {
+		return "fast-forwarded"
+	}
+	return "orphaned"
+}
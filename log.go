@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Logger writes structured log entries, one JSON object per line, with the
+// time, the message and the fields of the entry.
+// A nil *Logger discards all entries.
+type Logger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	fields map[string]interface{}
+	// now returns the time of the entries.
+	now func() time.Time
+}
+
+// NewLogger returns a Logger which writes to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{mu: &sync.Mutex{}, w: w, now: time.Now}
+}
+
+// With returns a Logger which adds the given fields, as alternating keys and
+// values, to every entry.
+func (l *Logger) With(kvs ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	nl := *l
+	nl.fields = l.withFields(kvs)
+	return &nl
+}
+
+// Log writes an entry with the given message and fields, as alternating keys
+// and values, in addition to those of the Logger.
+func (l *Logger) Log(msg string, kvs ...interface{}) {
+	if l == nil {
+		return
+	}
+	entry := l.withFields(kvs)
+	entry["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	entry["msg"] = msg
+	data, err := json.Marshal(entry)
+	onErrPanic(err)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.w.Write(append(data, '\n'))
+	onErrPanic(err)
+}
+
+func (l *Logger) withFields(kvs []interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(l.fields)+len(kvs)/2)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		fields[kvs[i].(string)] = kvs[i+1]
+	}
+	return fields
+}
+
+// newCorrelationID returns a random identifier for the log entries of a run of
+// the state machine.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	onErrPanic(err)
+	return hex.EncodeToString(b)
+}
+
+// branchNames returns the names of the merge candidate branches with the given
+// keys in the merge queue of the given base branch, for logging.
+func branchNames(base string, keys []BranchKey) []string {
+	names := make([]string, len(keys))
+	for i, bk := range keys {
+		names[i] = bk.BranchName(base)
+	}
+	return names
+}
+
+// logFetchedState logs a summary of the state fetched from github.
+func logFetchedState(log *Logger, base string, s State) {
+	log.Log("fetched state",
+		"base", s.Base,
+		"branches", branchNames(base, s.sortedBranchKeys()),
+		"mergeable_prs", len(s.MergeablePullRequests),
+		"cancelled_prs", len(s.CancelledPullRequests),
+		"blocked_prs", len(s.BlockedPullRequests),
+		"pending_prs", len(s.PendingPullRequests),
+		"waiting_prs", len(s.WaitingPullRequests),
+		"stacked_prs", len(s.StackedPullRequests),
+		"freeze", s.Freeze)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger(&buf)
+	log.now = func() time.Time { return time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC) }
+	log.With("pass", "abc").Log("created branch", "branch", "merge-candidate/main/1-1", "commit", CommitID("main"))
+	log.Log("reached terminal state")
+	require.Equal(t, `{"branch":"merge-candidate/main/1-1","commit":"main","msg":"created branch","pass":"abc","time":"2021-07-01T12:00:00Z"}
+{"msg":"reached terminal state","time":"2021-07-01T12:00:00Z"}
+`, buf.String())
+
+	// A nil Logger discards everything.
+	var nilLog *Logger
+	nilLog.With("pass", "abc").Log("discarded")
+}
+
+// TestLogStateMachine checks the transitions logged by a run of the state
+// machine on the two_open_prs test case.
+func TestLogStateMachine(t *testing.T) {
+	tci := readTestCaseInput(t, "two_open_prs")
+	c := tci.NewTestGithubClient(t)
+	var buf bytes.Buffer
+	StateMachine(&c, tci.Config, time.Second, NewLogger(&buf))
+
+	var msgs []string
+	var pass interface{}
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.NotEmpty(t, entry["pass"])
+		if pass == nil {
+			pass = entry["pass"]
+		}
+		require.Equal(t, pass, entry["pass"], "the correlation ID is the same for the whole pass")
+		msgs = append(msgs, entry["msg"].(string))
+		delete(entry, "time")
+		delete(entry, "pass")
+		entries = append(entries, entry)
+	}
+	require.Equal(t, []string{
+		"fetched state",
+		"picked next batch",
+		"created branch", "merged pull requests into branch",
+		"fetched state",
+		"picked next batch",
+		"created branch", "merged pull requests into branch",
+		"created branch", "merged pull requests into branch",
+		"fetched state",
+		"fast-forward",
+		"fetched state",
+		"pruned branch", "pruned branch",
+		"reached terminal state",
+	}, msgs)
+	require.Equal(t, map[string]interface{}{
+		"msg":    "fast-forward",
+		"base":   "main",
+		"target": "merge(main, pr-123)",
+		"path":   []interface{}{"merge-candidate/main/123-1"},
+	}, entries[11])
+	require.Equal(t, map[string]interface{}{
+		"msg":    "pruned branch",
+		"branch": "merge-candidate/main/123-1",
+		"reason": "fast-forwarded",
+	}, entries[13])
+	require.Equal(t, map[string]interface{}{
+		"msg":    "pruned branch",
+		"branch": "merge-candidate/main/456-1",
+		"reason": "orphaned",
+	}, entries[14])
+}
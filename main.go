@@ -1,44 +1,138 @@
 package main
 
 import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 	"os"
 	"time"
 )
 
+// defaultPollInterval is the time between runs of the state machine when the
+// metrics are served.
+const defaultPollInterval = time.Minute
+
+// maxFastForwardConflicts is the number of fast-forwards in a row which a run
+// of the state machine tolerates to fail because the base branch was pushed to
+// concurrently, before giving up.
+const maxFastForwardConflicts = 10
+
 // StateMachine walks through the state machine using a given GithubClient
 // interface until a terminal state is reached.
 // It begins by polling github for the set of merge candidate branches,
-// then repeatedly prunes these and fast-forwards the main branch until a steady
+// completing those which were left incomplete by an earlier run, then
+// repeatedly prunes these and fast-forwards the main branch until a steady
 // state is reached.
-// At this point it tries to enrich the set of merge candidate branches by
-// polling github for pull requests which have recently been marked either as
-// mergeable (by commenting "bors r+") or cancellable (with "bors r-").
+// Before each fast-forward, it polls github for pull requests which have
+// recently been marked either as mergeable (by commenting "bors r+") or
+// cancellable (with "bors r-"), and prunes the branches of those which have
+// been cancelled, which are blocked by the merge rules, or whose head changed
+// since they were approved. If the base branch was pushed to outside of the
+// merge queue, the build pipeline is rebuilt on top of it. While the base
+// branch is frozen, it only gets fast-forwarded through pull requests exempt
+// from the freeze, and the others which would have been merged are notified.
+// Once the steady state is reached, it tries to enrich the set of merge
+// candidate branches with those of the next batch of mergeable pull requests,
+// as determined by the configured PipelineStrategy.
 // The terminal state is reached if no additional branches were created.
-func StateMachine(c GithubClient, commentLookback time.Duration) {
+// It gives up with a panic if too many fast-forwards in a row conflict with
+// concurrent pushes to the base branch.
+// Each transition is logged, with a correlation ID identifying the run, and
+// traced in a span with child spans for the github API calls.
+func StateMachine(gc GithubClient, cfg Config, commentLookback time.Duration, log *Logger) {
+	pass := newCorrelationID()
+	log = log.With("pass", pass)
+	c := newInstrumentedGithubClient(gc, log)
+	timer := prometheus.NewTimer(c.metrics.reconciliationPassDuration)
+	defer timer.ObserveDuration()
+	defer c.startSpan("StateMachine", attribute.String("pass", pass))()
+	strategy := NewPipelineStrategy(cfg)
+	numConflicts := 0
 	for {
 		var s State
 		for {
-			s = FetchMergeCandidateBranchState(c)
-			t := s.BuildPipelineTree()
-			s = s.ToPrunedOrphanedBranches(c, t)
-			ff := s.FindFastForward(t)
+			var ff *CommitID
+			c.traced("iteration", func() {
+				c.traced("FetchMergeCandidateBranchState", func() {
+					s = FetchMergeCandidateBranchState(c)
+				})
+				c.traced("ToDecoratedWithPullRequests", func() {
+					s = s.ToDecoratedWithPullRequests(c, cfg, commentLookback)
+				})
+				logFetchedState(log, c.base, s)
+				c.traced("ToRecoveredBranches", func() {
+					s = c.logPruned(s, s.ToRecoveredBranches(c), incompleteReason)
+				})
+				previousBase := s.PreviousBase(s.BuildPipelineTree())
+				c.traced("ToPrunedStalePullRequests", func() {
+					s = c.logPruned(s, s.ToPrunedStalePullRequests(c, cfg.RequeueOnPush), staleReason)
+				})
+				c.traced("ToPrunedCancelledPullRequests", func() {
+					s = c.logPruned(s, s.ToPrunedCancelledPullRequests(c), cancelledReason)
+				})
+				if previousBase != "" {
+					c.traced("ToRebuiltPipeline", func() {
+						s = c.rebuildPipeline(s, previousBase)
+					})
+				}
+				t := s.BuildPipelineTree()
+				c.traced("ToPrunedOrphanedBranches", func() {
+					s = c.logPruned(s, s.ToPrunedOrphanedBranches(c, t), c.orphanedReason)
+				})
+				c.metrics.observe(s, t)
+				ff = s.FindFastForward(t)
+				if ff != nil {
+					c.traced("FastForwardBase", func() {
+						if c.fastForwardBase(s, t, *ff) {
+							numConflicts = 0
+						} else if numConflicts++; numConflicts >= maxFastForwardConflicts {
+							panic(fmt.Sprintf("%d fast-forward conflicts in a row", numConflicts))
+						}
+					})
+				} else if s.Freeze != "" {
+					c.traced("NotifyFrozenPullRequests", func() {
+						c.holdFastForward(s, t)
+					})
+				}
+			})
 			if ff == nil {
 				break
 			}
-			c.FastForwardBase(*ff)
 		}
-		s = s.ToDecoratedWithPullRequests(c, commentLookback)
-		s = s.ToPrunedCancelledPullRequests(c)
-		pr := s.NextMergeablePullRequest()
-		if pr == 0 {
+		t := s.BuildPipelineTree()
+		batch := strategy.NextBatch(s, t)
+		if len(batch) == 0 {
+			log.Log("reached terminal state")
 			break
 		}
-		t := s.BuildPipelineTree()
-		s.CreateBranchesForPullRequest(c, t, pr)
+		log.Log("picked next batch", "prs", batch)
+		c.traced("CreateBranchesForBatch", func() {
+			strategy.CreateBranchesForBatch(c, s, t, batch)
+		})
 	}
 }
 
 func main() {
+	shutdownTracing := SetupTracing()
+	defer shutdownTracing()
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		Simulate(ParseSimulationParams(os.Args[2:])).Report(os.Stdout)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fake-github" {
+		RunFakeGithubServer(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		RunDaemon(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 5 && (os.Args[1] == "freeze" || os.Args[1] == "unfreeze") {
+		// The arguments are the owner, the repo, the base branch and the token.
+		c := NewGithubClient(NewGithubHTTPClient(os.Args[5]), os.Getenv("GITHUB_API_URL"), os.Args[2], os.Args[3], os.Args[4], DefaultConfig())
+		c.SetFrozen(os.Args[1] == "freeze")
+		return
+	}
 	owner := os.Args[1]
 	repo := os.Args[2]
 	baseBranch := os.Args[3]
@@ -48,6 +142,28 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	c := NewGithubClient(owner, repo, baseBranch, oauth2Token)
-	StateMachine(c, commentsSince)
+	cfg := DefaultConfig()
+	if len(os.Args) > 6 {
+		cfg = ReadConfig(os.Args[6])
+	}
+	// GITHUB_API_URL overrides the github API URL, like in github actions.
+	c := NewGithubClient(NewGithubHTTPClient(oauth2Token), os.Getenv("GITHUB_API_URL"), owner, repo, baseBranch, cfg)
+	log := NewLogger(os.Stderr).With("repo", owner+"/"+repo, "base_branch", baseBranch)
+	MigrateLegacyBranches(c, log)
+	metricsAddr := os.Getenv("METRICS_ADDR")
+	if metricsAddr == "" {
+		StateMachine(c, cfg, commentsSince, log)
+		return
+	}
+	// Keep running the state machine for the metrics to be scraped.
+	pollInterval := defaultPollInterval
+	if v := os.Getenv("POLL_INTERVAL"); v != "" {
+		pollInterval, err = time.ParseDuration(v)
+		onErrPanic(err)
+	}
+	ServeMetrics(metricsAddr)
+	for {
+		StateMachine(c, cfg, commentsSince, log)
+		time.Sleep(pollInterval)
+	}
 }
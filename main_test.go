@@ -1,14 +1,19 @@
 package main
 
 import (
+	"flag"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 	"time"
 )
 
+var rewrite = flag.Bool("rewrite", false, "rewrite the expected output files of the data-driven test cases")
+
 const testDataDir = "testdata"
 const inputSuffix = ".in.yaml"
 const outputSuffix = ".out.yaml"
@@ -18,7 +23,11 @@ const outputSuffix = ".out.yaml"
 // The input file is parsed into a TestCaseInput, see that type definition for
 // more details.
 // The output file encodes the expected state of the TestCaseOutput at the end of
-// the run, again see that type definition for more details.
+// the run, again see that type definition for more details. For scenarios, in
+// which the input has steps, it encodes the list of TestCaseOutputs of the run
+// steps instead.
+// With the -rewrite flag, the output files are rewritten with the actual output
+// instead.
 func TestDataDriven(t *testing.T) {
 	finfo, err := ioutil.ReadDir(testDataDir)
 	require.NoError(t, err)
@@ -30,22 +39,62 @@ func TestDataDriven(t *testing.T) {
 
 		// Run a data-driven test case.
 		t.Run(caseName, func(t *testing.T) {
-			input, err := ioutil.ReadFile(testDataDir + "/" + caseName + inputSuffix)
-			require.NoError(t, err)
-			expectedOutput, err := ioutil.ReadFile(testDataDir + "/" + caseName + outputSuffix)
-			require.NoError(t, err)
-
-			var tci TestCaseInput
-			err = yaml.Unmarshal(input, &tci)
-			require.NoError(t, err)
-
+			t.Parallel()
+			tci := readTestCaseInput(t, caseName)
 			c := tci.NewTestGithubClient(t)
 			const fakeDuration = time.Second
-			StateMachine(&c, fakeDuration)
+			outputs := tci.RunSteps(&c, fakeDuration)
+
+			var actualOutput []byte
+			var err error
+			if len(tci.Steps) == 0 {
+				actualOutput, err = yaml.Marshal(outputs[0])
+			} else {
+				actualOutput, err = yaml.Marshal(outputs)
+			}
+			require.NoError(t, err)
 
-			actualOutput, err := yaml.Marshal(c.ToTestCaseOutput())
+			outputPath := testDataDir + "/" + caseName + outputSuffix
+			if *rewrite {
+				require.NoError(t, ioutil.WriteFile(outputPath, actualOutput, 0644))
+				return
+			}
+			expectedOutput, err := ioutil.ReadFile(outputPath)
+			if os.IsNotExist(err) {
+				t.Fatalf("%s not found, run with -rewrite to create it", outputPath)
+			}
 			require.NoError(t, err)
-			require.Equal(t, string(expectedOutput), string(actualOutput))
+			if diff := unifiedDiff(outputPath, string(expectedOutput), string(actualOutput)); diff != "" {
+				t.Fatalf("unexpected output, run with -rewrite to accept it:\n%s", diff)
+			}
 		})
 	}
 }
+
+// readTestCaseInput reads the input of a data-driven test case.
+func readTestCaseInput(t testing.TB, caseName string) TestCaseInput {
+	input, err := ioutil.ReadFile(testDataDir + "/" + caseName + inputSuffix)
+	require.NoError(t, err)
+	tci := TestCaseInput{Config: DefaultConfig()}
+	require.NoError(t, yaml.Unmarshal(input, &tci))
+	return tci
+}
+
+// unifiedDiff returns the unified diff from the expected to the actual output
+// of a test case, or an empty string if they are the same.
+func unifiedDiff(path, expected, actual string) string {
+	if expected == actual {
+		return ""
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(expected),
+		B:        difflib.SplitLines(actual),
+		FromFile: path,
+		ToFile:   "actual",
+		Context:  3,
+	})
+	if err != nil {
+		return err.Error()
+	}
+	return diff
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+)
+
+const metricsNamespace = "merge_queue"
+
+// queueLabels are the labels which identify the merge queue of the metrics
+// of a base branch, in a github repo.
+var queueLabels = []string{"repo", "base"}
+
+// The metrics below are exported to prometheus on the /metrics endpoint, see
+// ServeMetrics. The share of wasted merge candidate branches is the ratio of
+// the rates of candidateBranchesWasted and candidateBranchesCreated.
+var (
+	queueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queued_pull_requests",
+		Help:      "Number of pull requests approved for merging and not merged yet.",
+	}, queueLabels)
+	candidateBranches = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "candidate_branches",
+		Help:      "Number of merge candidate branches in the build pipeline, by state: live or tombstone.",
+	}, append([]string{"state"}, queueLabels...))
+	candidateBranchesCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "candidate_branches_created_total",
+		Help:      "Number of merge candidate branches created.",
+	}, queueLabels)
+	candidateBranchesWasted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "candidate_branches_wasted_total",
+		Help:      "Number of merge candidate branches deleted without the base branch being fast-forwarded through them.",
+	}, queueLabels)
+	fastForwards = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fast_forwards_total",
+		Help:      "Number of fast-forwards of the base branch.",
+	}, queueLabels)
+	fastForwardConflicts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "fast_forward_conflicts_total",
+		Help:      "Number of fast-forwards of the base branch which failed because it was pushed to concurrently.",
+	}, queueLabels)
+	externalBasePushes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "external_base_pushes_total",
+		Help:      "Number of pushes to the base branch outside of the merge queue, after which the build pipeline was rebuilt.",
+	}, queueLabels)
+	frozen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "frozen",
+		Help:      "Whether the base branch is frozen, either by bors freeze or outside of the merge windows: 1 if it is, 0 otherwise.",
+	}, queueLabels)
+	timeToMerge = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "time_to_merge_seconds",
+		Help:      "Time from the approval of a pull request with bors merge to its merge into the base branch.",
+		Buckets:   prometheus.ExponentialBuckets(60, 2, 12),
+	}, queueLabels)
+	reconciliationPassDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "reconciliation_pass_duration_seconds",
+		Help:      "Duration of the runs of the state machine until a terminal state is reached.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	}, queueLabels)
+	githubAPIRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_api_requests_total",
+		Help:      "Number of github API requests, by HTTP method and response status.",
+	}, []string{"method", "status"})
+	githubRateLimitRemaining = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "github_rate_limit_remaining",
+		Help:      "Number of github API requests remaining in the current rate limit window.",
+	})
+)
+
+// queueMetrics are the metrics of the merge queue of a base branch.
+type queueMetrics struct {
+	queueLength                prometheus.Gauge
+	liveBranches, tombstones   prometheus.Gauge
+	branchesCreated            prometheus.Counter
+	branchesWasted             prometheus.Counter
+	fastForwards               prometheus.Counter
+	fastForwardConflicts       prometheus.Counter
+	externalBasePushes         prometheus.Counter
+	frozen                     prometheus.Gauge
+	timeToMerge                prometheus.Observer
+	reconciliationPassDuration prometheus.Observer
+}
+
+// newQueueMetrics returns the metrics of the merge queue of a base branch in a
+// github repo, which are empty if unknown.
+func newQueueMetrics(repo, base string) queueMetrics {
+	return queueMetrics{
+		queueLength:                queueLength.WithLabelValues(repo, base),
+		liveBranches:               candidateBranches.WithLabelValues("live", repo, base),
+		tombstones:                 candidateBranches.WithLabelValues("tombstone", repo, base),
+		branchesCreated:            candidateBranchesCreated.WithLabelValues(repo, base),
+		branchesWasted:             candidateBranchesWasted.WithLabelValues(repo, base),
+		fastForwards:               fastForwards.WithLabelValues(repo, base),
+		fastForwardConflicts:       fastForwardConflicts.WithLabelValues(repo, base),
+		externalBasePushes:         externalBasePushes.WithLabelValues(repo, base),
+		frozen:                     frozen.WithLabelValues(repo, base),
+		timeToMerge:                timeToMerge.WithLabelValues(repo, base),
+		reconciliationPassDuration: reconciliationPassDuration.WithLabelValues(repo, base),
+	}
+}
+
+// queueIdentifier is implemented by GithubClients which know which merge
+// queue they manage, for its metrics and the names of its branches.
+type queueIdentifier interface {
+	// QueueLabels returns the repo, as "owner/repo", and the base branch.
+	QueueLabels() (repo, base string)
+}
+
+// queueLabelsFor returns the repo and the base branch of the merge queue
+// managed by a GithubClient, which are empty if unknown.
+func queueLabelsFor(c GithubClient) (repo, base string) {
+	if qi, ok := c.(queueIdentifier); ok {
+		return qi.QueueLabels()
+	}
+	return "", ""
+}
+
+// ServeMetrics serves the prometheus metrics on the /metrics endpoint of the
+// given address, in the background.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		onErrPanic(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// observe updates the metrics on the queue and on the build pipeline.
+func (m queueMetrics) observe(s State, t PipelineTree) {
+	m.queueLength.Set(float64(len(s.MergeablePullRequests)))
+	if s.Freeze != "" {
+		m.frozen.Set(1)
+	} else {
+		m.frozen.Set(0)
+	}
+	numLive, numTombstones := 0, 0
+	for _, pv := range t {
+		if pv.IsNotInPipeline {
+			numTombstones++
+		} else {
+			numLive++
+		}
+	}
+	m.liveBranches.Set(float64(numLive))
+	m.tombstones.Set(float64(numTombstones))
+}
+
+// metricsTransport is an http.RoundTripper which counts the github API
+// requests and keeps track of the rate limit.
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (mt metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := mt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		githubAPIRequests.WithLabelValues(req.Method, "error").Inc()
+		return resp, err
+	}
+	githubAPIRequests.WithLabelValues(req.Method, strconv.Itoa(resp.StatusCode)).Inc()
+	if remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining")); err == nil {
+		githubRateLimitRemaining.Set(float64(remaining))
+	}
+	return resp, nil
+}
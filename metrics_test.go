@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestMetricsStateMachine checks the metrics fed by a run of the state machine
+// on the two_open_prs test case: three branches get created, the base branch
+// gets fast-forwarded through one of them, and one of the other two is wasted.
+func TestMetricsStateMachine(t *testing.T) {
+	tci := readTestCaseInput(t, "two_open_prs")
+	c := tci.NewTestGithubClient(t)
+
+	m := newQueueMetrics(c.QueueLabels())
+	created := testutil.ToFloat64(m.branchesCreated)
+	wasted := testutil.ToFloat64(m.branchesWasted)
+	ffs := testutil.ToFloat64(m.fastForwards)
+	StateMachine(&c, tci.Config, time.Second, nil)
+	require.Equal(t, 3.0, testutil.ToFloat64(m.branchesCreated)-created)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.branchesWasted)-wasted)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.fastForwards)-ffs)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.queueLength))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.liveBranches))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.tombstones))
+}
+
+// TestMetricsFastForwardConflict checks the metrics fed by a run of the state
+// machine on the two_open_prs test case, when the base branch gets pushed to
+// right before the fast-forward: the fast-forward fails, and the build pipeline
+// gets rebuilt on top of the base branch.
+func TestMetricsFastForwardConflict(t *testing.T) {
+	tci := readTestCaseInput(t, "two_open_prs")
+	c := tci.NewTestGithubClient(t)
+	c.racingBasePush = "hotfix"
+
+	m := newQueueMetrics(c.QueueLabels())
+	conflicts := testutil.ToFloat64(m.fastForwardConflicts)
+	pushes := testutil.ToFloat64(m.externalBasePushes)
+	StateMachine(&c, tci.Config, time.Second, nil)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.fastForwardConflicts)-conflicts)
+	require.Equal(t, 1.0, testutil.ToFloat64(m.externalBasePushes)-pushes)
+	require.Equal(t, CommitID("hotfix"), c.baseHead)
+}
+
+// alwaysConflictingGithubClient fails every fast-forward, as if the base
+// branch kept getting pushed to.
+type alwaysConflictingGithubClient struct {
+	*TestGithubClient
+}
+
+func (c alwaysConflictingGithubClient) FastForwardBase(CommitID, CommitID) bool {
+	return false
+}
+
+// TestMetricsFastForwardConflictsInARow checks that the state machine gives up
+// after too many fast-forward conflicts in a row, after counting them.
+func TestMetricsFastForwardConflictsInARow(t *testing.T) {
+	tci := readTestCaseInput(t, "two_open_prs")
+	c := tci.NewTestGithubClient(t)
+
+	m := newQueueMetrics(c.QueueLabels())
+	conflicts := testutil.ToFloat64(m.fastForwardConflicts)
+	require.Panics(t, func() {
+		StateMachine(alwaysConflictingGithubClient{&c}, tci.Config, time.Second, nil)
+	})
+	require.Equal(t, float64(maxFastForwardConflicts), testutil.ToFloat64(m.fastForwardConflicts)-conflicts)
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "4321")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	notFound := githubAPIRequests.WithLabelValues("GET", "404")
+	before := testutil.ToFloat64(notFound)
+	hc := &http.Client{Transport: metricsTransport{base: server.Client().Transport}}
+	resp, err := hc.Get(server.URL + "/missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 1.0, testutil.ToFloat64(notFound)-before)
+	require.Equal(t, 4321.0, testutil.ToFloat64(githubRateLimitRemaining))
+}
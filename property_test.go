@@ -0,0 +1,385 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var propertySeed = flag.Int64("property.seed", 0, "run TestStateMachineProperties for this seed only")
+var propertyIterations = flag.Int("property.iterations", 200, "number of random test cases in TestStateMachineProperties")
+var propertyFixture = flag.String("property.fixture", "", "file to write the shrunk input of a failing random test case to")
+
+// maxPropertyAPICalls bounds the number of github API calls which change the
+// state of the repo in a random test case, beyond which the state machine is
+// deemed not to terminate.
+const maxPropertyAPICalls = 1000
+
+// TestStateMachineProperties runs the state machine against randomly
+// generated test case inputs and checks that it maintains its invariants:
+// - the base only moves forward, and only to commits whose checks passed;
+// - no pull request is merged twice;
+// - no orphaned branches remain;
+// - cancelled pull requests never land.
+// The mock github client also fails on any call which makes no sense, such as
+// merging an unmergeable pull request.
+// The input of a failing case is shrunk to a minimal one which still fails,
+// which is logged as yaml and can be turned into a data-driven test case.
+func TestStateMachineProperties(t *testing.T) {
+	seeds := make([]int64, 0, *propertyIterations)
+	if *propertySeed != 0 {
+		seeds = append(seeds, *propertySeed)
+	} else {
+		for i := 1; i <= *propertyIterations; i++ {
+			seeds = append(seeds, int64(i))
+		}
+	}
+	for _, seed := range seeds {
+		tci := randomTestCaseInput(rand.New(rand.NewSource(seed)))
+		failure := runPropertyTestCase(t, tci)
+		if failure == "" {
+			continue
+		}
+		tci, failure = shrinkTestCaseInput(t, tci, failure)
+		out := marshalTestCaseInput(t, tci)
+		if *propertyFixture != "" {
+			require.NoError(t, ioutil.WriteFile(*propertyFixture, out, 0644))
+		}
+		t.Fatalf("seed %d: %s\nshrunk input:\n%s", seed, failure, out)
+	}
+}
+
+// propertyFailure is the panic value which aborts a random test case.
+type propertyFailure string
+
+// propertyT intercepts the failures of the mock github client to abort the
+// random test case instead of the test.
+type propertyT struct {
+	testing.TB
+}
+
+func (propertyT) Fatal(args ...interface{}) {
+	panic(propertyFailure(fmt.Sprint(args...)))
+}
+
+func (propertyT) Fatalf(format string, args ...interface{}) {
+	panic(propertyFailure(fmt.Sprintf(format, args...)))
+}
+
+// invariantGithubClient wraps the mock github client to check the invariants
+// after each call which changes the state of the repo.
+type invariantGithubClient struct {
+	*TestGithubClient
+	cancelled map[PullRequestNumber]struct{}
+	numCalls  int
+}
+
+var testPRCommitRe = regexp.MustCompile(`pr-(\d+)`)
+
+func (c *invariantGithubClient) CreateBranch(bk BranchKey, sha CommitID) {
+	c.TestGithubClient.CreateBranch(bk, sha)
+	c.checkInvariants()
+}
+
+func (c *invariantGithubClient) DeleteBranch(bk BranchKey) {
+	c.TestGithubClient.DeleteBranch(bk)
+	c.checkInvariants()
+}
+
+func (c *invariantGithubClient) MergeBranch(bk BranchKey, prs []MergedPullRequest) MergeResult {
+	result := c.TestGithubClient.MergeBranch(bk, prs)
+	c.checkInvariants()
+	return result
+}
+
+func (c *invariantGithubClient) PostComment(number PullRequestNumber, msg string) {
+	c.TestGithubClient.PostComment(number, msg)
+	c.checkInvariants()
+}
+
+func (c *invariantGithubClient) FastForwardBase(old, sha CommitID) bool {
+	if old != c.baseHead {
+		c.Fatalf("fast-forward from %s while the base is %s", old, c.baseHead)
+	}
+	if sha == old {
+		c.Fatalf("fast-forward to current base %s", sha)
+	}
+	// Commit names nest the names of their ancestors.
+	if !strings.Contains(string(sha), string(old)) {
+		c.Fatalf("fast-forward from %s to %s which is not a descendant", old, sha)
+	}
+	isPass := false
+	for _, bv := range c.branches {
+		isPass = isPass || (bv.CommitID == sha && bv.IsCheckDone && bv.IsCheckPass)
+	}
+	if !isPass {
+		c.Fatalf("fast-forward to %s whose checks haven't passed", sha)
+	}
+	c.TestGithubClient.FastForwardBase(old, sha)
+	merged := map[PullRequestNumber]struct{}{}
+	for _, m := range testPRCommitRe.FindAllStringSubmatch(string(sha), -1) {
+		n, _ := strconv.Atoi(m[1])
+		number := PullRequestNumber(n)
+		if _, ok := merged[number]; ok {
+			c.Fatalf("#%d merged twice into %s", number, sha)
+		}
+		if _, ok := c.cancelled[number]; ok {
+			c.Fatalf("cancelled #%d merged into %s", number, sha)
+		}
+		merged[number] = struct{}{}
+	}
+	c.checkInvariants()
+	return true
+}
+
+func (c *invariantGithubClient) checkInvariants() {
+	c.numCalls++
+	if c.numCalls > maxPropertyAPICalls {
+		c.Fatalf("state machine doesn't terminate")
+	}
+}
+
+// checkNoOrphans checks that all merge candidate branches are complete and
+// based off the base branch, directly or indirectly, once the state machine is
+// done. Branches into which a merge failed are deleted right away.
+func (c *invariantGithubClient) checkNoOrphans() {
+	for _, bk := range c.sortedBranchKeys() {
+		bv := c.branches[bk]
+		if !bv.isValid {
+			c.Fatalf("incomplete branch %s", bk.BranchName(testBaseBranch))
+		}
+		if c.walkBackToBase(bk, bv) == nil {
+			c.Fatalf("orphaned branch %s", bk.BranchName(testBaseBranch))
+		}
+	}
+}
+
+func (c *invariantGithubClient) sortedBranchKeys() []BranchKey {
+	return State{Branches: c.branches}.sortedBranchKeys()
+}
+
+// runPropertyTestCase runs the state machine for a test case input and returns
+// a description of the first failure, if any.
+func runPropertyTestCase(t *testing.T, tci TestCaseInput) (failure string) {
+	defer func() {
+		if r := recover(); r != nil {
+			if f, ok := r.(propertyFailure); ok {
+				failure = string(f)
+			} else {
+				failure = fmt.Sprintf("panic: %v", r)
+			}
+		}
+	}()
+	tc := tci.NewTestGithubClient(propertyT{TB: t})
+	c := &invariantGithubClient{TestGithubClient: &tc, cancelled: map[PullRequestNumber]struct{}{}}
+	for number, comments := range tci.MergeablePullRequests {
+		if len(comments) > 0 && comments[len(comments)-1] == "bors cancel" {
+			c.cancelled[PullRequestNumber(number)] = struct{}{}
+		}
+	}
+	StateMachine(c, tci.Config, time.Second, nil)
+	c.checkNoOrphans()
+	return ""
+}
+
+// randomTestCaseInput generates a random test case input, in which a handful of
+// pull requests are to be merged, some of which get cancelled or have merge
+// conflicts, and in which the checks pass or fail for some of the possible
+// merge candidate commits.
+func randomTestCaseInput(rng *rand.Rand) TestCaseInput {
+	tci := TestCaseInput{
+		Config:                  DefaultConfig(),
+		MergeablePullRequests:   map[int][]string{},
+		UnmergeablePullRequests: map[int][]string{},
+		MergeConflicts:          map[string][]int{},
+		PassingCommits:          map[string]uint{},
+		FailingCommits:          map[string]uint{},
+	}
+	tci.MergeStrategy = []MergeStrategy{MergeCommitStrategy, SquashStrategy, RebaseStrategy}[rng.Intn(3)]
+	tci.PipelineStrategy = []PipelineStrategyName{
+		PipelineStrategyPipeline, PipelineStrategyBatch, PipelineStrategyHybrid}[rng.Intn(3)]
+	tci.MaxBatchSize = 1 + rng.Intn(4)
+	numPRs := 1 + rng.Intn(6)
+	for n := 1; n <= numPRs; n++ {
+		switch x := rng.Float64(); {
+		case x < 0.1:
+			tci.UnmergeablePullRequests[n] = []string{"bors merge"}
+		case x < 0.3:
+			tci.MergeablePullRequests[n] = []string{"bors merge", "bors cancel"}
+		default:
+			tci.MergeablePullRequests[n] = []string{"bors merge"}
+		}
+		if rng.Float64() < 0.15 {
+			bk := BranchKey{PullRequestNumber: PullRequestNumber(n), PipelineCounter: 1 + rng.Intn(3)}
+			tci.MergeConflicts[bk.BranchName(testBaseBranch)] = []int{1 + rng.Intn(numPRs)}
+		}
+	}
+	for i := 0; i < 2*numPRs; i++ {
+		sha := CommitID(testBaseHead)
+		for _, n := range rng.Perm(numPRs)[:1+rng.Intn(minInt(3, numPRs))] {
+			sha = testCommitID(tci.MergeStrategy, sha, testPRCommitID(PullRequestNumber(n+1)))
+		}
+		counter := uint(1 + rng.Intn(3))
+		if rng.Float64() < 0.7 {
+			tci.PassingCommits[string(sha)] = counter
+		} else {
+			tci.FailingCommits[string(sha)] = counter
+		}
+	}
+	return tci
+}
+
+// shrinkTestCaseInput greedily simplifies a failing test case input for as
+// long as it keeps failing, and returns the simplest one along with its
+// failure.
+func shrinkTestCaseInput(t *testing.T, tci TestCaseInput, failure string) (TestCaseInput, string) {
+	for {
+		isShrunk := false
+		for _, candidate := range shrinkCandidates(t, tci) {
+			if f := runPropertyTestCase(t, candidate); f != "" {
+				tci, failure, isShrunk = candidate, f, true
+				break
+			}
+		}
+		if !isShrunk {
+			return tci, failure
+		}
+	}
+}
+
+// shrinkCandidates returns the test case inputs which are one simplification
+// away from the given one.
+func shrinkCandidates(t *testing.T, tci TestCaseInput) []TestCaseInput {
+	var candidates []TestCaseInput
+	add := func(fn func(c *TestCaseInput)) {
+		c := copyTestCaseInput(t, tci)
+		fn(&c)
+		candidates = append(candidates, c)
+	}
+	for _, n := range sortedCommentKeys(tci.MergeablePullRequests) {
+		n := n
+		add(func(c *TestCaseInput) { delete(c.MergeablePullRequests, n) })
+		if len(tci.MergeablePullRequests[n]) > 1 {
+			add(func(c *TestCaseInput) { c.MergeablePullRequests[n] = c.MergeablePullRequests[n][:1] })
+		}
+	}
+	for _, n := range sortedCommentKeys(tci.UnmergeablePullRequests) {
+		n := n
+		add(func(c *TestCaseInput) { delete(c.UnmergeablePullRequests, n) })
+	}
+	for _, k := range sortedConflictKeys(tci.MergeConflicts) {
+		k := k
+		add(func(c *TestCaseInput) { delete(c.MergeConflicts, k) })
+	}
+	for _, commits := range []func(c *TestCaseInput) map[string]uint{
+		func(c *TestCaseInput) map[string]uint { return c.PassingCommits },
+		func(c *TestCaseInput) map[string]uint { return c.FailingCommits },
+	} {
+		commits := commits
+		m := commits(&tci)
+		for _, sha := range sortedCommitKeys(m) {
+			sha := sha
+			add(func(c *TestCaseInput) { delete(commits(c), sha) })
+			if m[sha] > 1 {
+				add(func(c *TestCaseInput) { commits(c)[sha]-- })
+			}
+		}
+	}
+	if tci.PipelineStrategy != PipelineStrategyPipeline {
+		add(func(c *TestCaseInput) { c.PipelineStrategy = PipelineStrategyPipeline })
+	}
+	if tci.MergeStrategy != MergeCommitStrategy {
+		// Commit names depend on the merge strategy.
+		add(func(c *TestCaseInput) {
+			from, to := string(c.MergeStrategy)+"(", string(MergeCommitStrategy)+"("
+			c.MergeStrategy = MergeCommitStrategy
+			for _, m := range []map[string]uint{c.PassingCommits, c.FailingCommits} {
+				for _, sha := range sortedCommitKeys(m) {
+					counter := m[sha]
+					delete(m, sha)
+					m[strings.Replace(sha, from, to, -1)] = counter
+				}
+			}
+		})
+	}
+	if tci.MaxBatchSize > 1 {
+		add(func(c *TestCaseInput) { c.MaxBatchSize-- })
+	}
+	return candidates
+}
+
+// marshalTestCaseInput encodes a test case input as yaml, leaving out the
+// settings which have their default values.
+func marshalTestCaseInput(t *testing.T, tci TestCaseInput) []byte {
+	d := DefaultConfig()
+	if tci.MergeStrategy == d.MergeStrategy {
+		tci.MergeStrategy = ""
+	}
+	if tci.CommitMessageTemplate == d.CommitMessageTemplate {
+		tci.CommitMessageTemplate = ""
+	}
+	if tci.PipelineStrategy == d.PipelineStrategy {
+		tci.PipelineStrategy = ""
+	}
+	if tci.MaxBatchSize == d.MaxBatchSize {
+		tci.MaxBatchSize = 0
+	}
+	if tci.MergeabilityTimeout == d.MergeabilityTimeout {
+		tci.MergeabilityTimeout = 0
+	}
+	if tci.MaxConcurrentRequests == d.MaxConcurrentRequests {
+		tci.MaxConcurrentRequests = 0
+	}
+	out, err := yaml.Marshal(tci)
+	require.NoError(t, err)
+	return out
+}
+
+func copyTestCaseInput(t *testing.T, tci TestCaseInput) TestCaseInput {
+	c := TestCaseInput{Config: DefaultConfig()}
+	require.NoError(t, yaml.Unmarshal(marshalTestCaseInput(t, tci), &c))
+	return c
+}
+
+func sortedCommentKeys(m map[int][]string) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedConflictKeys(m map[string][]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCommitKeys(m map[string]uint) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitTransport is an http.RoundTripper which keeps track of the github
+// API rate limit, and which holds back requests once it is exhausted until it
+// gets reset, instead of making requests which would fail.
+type rateLimitTransport struct {
+	base http.RoundTripper
+	mu   sync.Mutex
+	// isExhausted is true iff no requests remain until reset.
+	isExhausted bool
+	reset       time.Time
+	// now returns the current time.
+	now func() time.Time
+}
+
+func (rt *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := rt.wait(); wait > 0 {
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+	}
+	base := rt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return resp, nil
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return resp, nil
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.isExhausted = remaining == 0
+	rt.reset = time.Unix(reset, 0)
+	return resp, nil
+}
+
+// wait returns how long to wait before making a request.
+func (rt *rateLimitTransport) wait() time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if !rt.isExhausted {
+		return 0
+	}
+	now := time.Now()
+	if rt.now != nil {
+		now = rt.now()
+	}
+	if wait := rt.reset.Sub(now); wait > 0 {
+		return wait
+	}
+	rt.isExhausted = false
+	return 0
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	reset := time.Date(2021, 7, 1, 12, 0, 0, 0, time.UTC)
+	remaining := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	}))
+	defer server.Close()
+	rt := &rateLimitTransport{base: server.Client().Transport}
+	hc := &http.Client{Transport: rt}
+	get := func() {
+		resp, err := hc.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	rt.now = func() time.Time { return reset.Add(-time.Minute) }
+	get()
+	require.Zero(t, rt.wait())
+
+	// The rate limit is exhausted until it gets reset.
+	remaining = 0
+	get()
+	require.Equal(t, time.Minute, rt.wait())
+	rt.now = func() time.Time { return reset.Add(time.Second) }
+	require.Zero(t, rt.wait())
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a cron-style schedule, with minute, hour, day of month,
+// month and day of week fields, which matches the times of the minutes it
+// covers. Each field is either "*" or a comma-separated list of values and
+// ranges such as "1-5", possibly with steps such as "*/15" or "0-30/10". Days
+// of the week go from 0 for Sunday to 6, 7 being Sunday as well. As in cron,
+// if both the day of month and the day of week are restricted, which is to say
+// that they don't start with "*", a time matches if either of them does.
+type cronSchedule struct {
+	minutes, hours, daysOfMonth, months, daysOfWeek map[int]bool
+	isDayOfMonthRestricted, isDayOfWeekRestricted   bool
+}
+
+// parseCronSchedule parses a cron-style schedule.
+func parseCronSchedule(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("schedule %q doesn't have 5 fields", spec)
+	}
+	s := cronSchedule{
+		isDayOfMonthRestricted: !strings.HasPrefix(fields[2], "*"),
+		isDayOfWeekRestricted:  !strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	for i, f := range []struct {
+		values   *map[int]bool
+		min, max int
+	}{
+		{&s.minutes, 0, 59},
+		{&s.hours, 0, 23},
+		{&s.daysOfMonth, 1, 31},
+		{&s.months, 1, 12},
+		{&s.daysOfWeek, 0, 7},
+	} {
+		if *f.values, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return cronSchedule{}, fmt.Errorf("schedule %q: %v", spec, err)
+		}
+	}
+	if s.daysOfWeek[7] {
+		s.daysOfWeek[0] = true
+	}
+	return s, nil
+}
+
+// parseCronField parses a field of a cron-style schedule, whose values range
+// from min to max, into the set of values it matches.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			rng = part[:i]
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value in %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of the range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// Matches returns true iff the schedule covers the minute of the given time.
+func (s cronSchedule) Matches(t time.Time) bool {
+	if !s.minutes[t.Minute()] || !s.hours[t.Hour()] || !s.months[int(t.Month())] {
+		return false
+	}
+	isDayOfMonth, isDayOfWeek := s.daysOfMonth[t.Day()], s.daysOfWeek[int(t.Weekday())]
+	if s.isDayOfMonthRestricted && s.isDayOfWeekRestricted {
+		return isDayOfMonth || isDayOfWeek
+	}
+	return isDayOfMonth && isDayOfWeek
+}
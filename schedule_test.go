@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// 2021-09-06 is a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2021, time.September, day, hour, minute, 0, 0, time.UTC)
+	}
+	for _, tc := range []struct {
+		spec    string
+		t       time.Time
+		matches bool
+	}{
+		{"* * * * *", at(6, 0, 0), true},
+		{"* 9-17 * * 1-5", at(6, 9, 0), true},
+		{"* 9-17 * * 1-5", at(6, 17, 59), true},
+		{"* 9-17 * * 1-5", at(6, 18, 0), false},
+		{"* 9-17 * * 1-5", at(11, 12, 0), false},
+		{"* * * * 0,6", at(12, 12, 0), true},
+		{"* * * * 7", at(12, 12, 0), true},
+		{"*/15 * * * *", at(6, 12, 30), true},
+		{"*/15 * * * *", at(6, 12, 31), false},
+		{"10/20 * * * *", at(6, 12, 50), true},
+		{"0-30/10 * * * *", at(6, 12, 40), false},
+		{"* * * 10-12 *", at(6, 12, 0), false},
+		// Either the day of month or the day of week.
+		{"* * 1 * 1", at(6, 12, 0), true},
+		{"* * 6 * 5", at(6, 12, 0), true},
+		{"* * 7 * 5", at(6, 12, 0), false},
+		{"* * */2 * *", at(6, 12, 0), false},
+	} {
+		s, err := parseCronSchedule(tc.spec)
+		require.NoError(t, err, tc.spec)
+		require.Equal(t, tc.matches, s.Matches(tc.t), "%s at %s", tc.spec, tc.t)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+	} {
+		_, err := parseCronSchedule(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestIsInMergeWindow(t *testing.T) {
+	cfg := DefaultConfig()
+	now := time.Date(2021, time.September, 6, 16, 30, 0, 0, time.UTC)
+	require.True(t, cfg.IsInMergeWindow(now))
+
+	cfg.MergeWindows = []string{"* 9-17 * * 1-5", "0-29 10 * * 6"}
+	require.NoError(t, cfg.Validate())
+	require.True(t, cfg.IsInMergeWindow(now))
+	require.False(t, cfg.IsInMergeWindow(now.Add(2*time.Hour)))
+	require.True(t, cfg.IsInMergeWindow(time.Date(2021, time.September, 11, 10, 0, 0, 0, time.UTC)))
+
+	// 16:30 UTC is 18:30 in Paris in summer.
+	cfg.MergeWindowTimeZone = "Europe/Paris"
+	require.NoError(t, cfg.Validate())
+	require.False(t, cfg.IsInMergeWindow(now))
+	require.True(t, cfg.IsInMergeWindow(now.Add(-2*time.Hour)))
+
+	cfg.MergeWindowTimeZone = "Nowhere/Special"
+	require.Error(t, cfg.Validate())
+	cfg.MergeWindowTimeZone = ""
+	cfg.MergeWindows = []string{"* 9-17 * *"}
+	require.Error(t, cfg.Validate())
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SimulationParams defines a simulation run, see Simulate.
+type SimulationParams struct {
+	// Duration is the simulated time span.
+	Duration time.Duration
+	// ArrivalRate is the mean number of pull requests approved for merging per
+	// hour, arrivals follow a Poisson process.
+	ArrivalRate float64
+	// BuildMean and BuildStdDev define the normal distribution of the
+	// durations of check suite runs.
+	BuildMean   time.Duration
+	BuildStdDev time.Duration
+	// FlakeRate is the probability that a check suite run fails regardless of
+	// the pull requests it contains.
+	FlakeRate float64
+	// FailureRate is the probability that a pull request is broken, in which
+	// case every check suite run containing it fails. The author closes it as
+	// soon as a merge candidate branch for it fails.
+	FailureRate float64
+	// SampleInterval is the interval at which the queue length is sampled.
+	SampleInterval time.Duration
+	// Seed seeds the pseudo-random number generator.
+	Seed int64
+	// Config is the configuration of the simulated repo.
+	Config Config
+}
+
+// QueueSample is the number of approved pull requests which have neither been
+// merged nor closed, at a point in simulated time.
+type QueueSample struct {
+	Time   time.Duration
+	Length int
+}
+
+// SimulationResult holds the measurements of a simulation run.
+type SimulationResult struct {
+	Params SimulationParams
+	// Arrived, Merged and Rejected count the pull requests which were
+	// approved, merged, and closed by their authors after failing,
+	// respectively.
+	Arrived  int
+	Merged   int
+	Rejected int
+	// BrokenMerged counts the broken pull requests which were merged, this
+	// should always be zero.
+	BrokenMerged int
+	// Latencies are the durations between approval and merge of all merged
+	// pull requests, sorted.
+	Latencies []time.Duration
+	// BuildsStarted and BuildsCancelled count the check suite runs which
+	// started, and those which were cancelled before completing because their
+	// merge candidate branch got deleted.
+	BuildsStarted   int
+	BuildsCancelled int
+	// CITime is the total duration of all check suite runs.
+	CITime time.Duration
+	// QueueLength samples the queue length over time.
+	QueueLength []QueueSample
+}
+
+// ParseSimulationParams parses the command line arguments of the simulate
+// command.
+// Any errors will result in a panic.
+func ParseSimulationParams(args []string) SimulationParams {
+	fs := flag.NewFlagSet("simulate", flag.PanicOnError)
+	p := SimulationParams{Config: DefaultConfig()}
+	fs.DurationVar(&p.Duration, "duration", 7*24*time.Hour, "simulated time span")
+	fs.Float64Var(&p.ArrivalRate, "arrival-rate", 2, "mean number of pull requests approved per hour")
+	fs.DurationVar(&p.BuildMean, "build-mean", time.Hour, "mean check suite run duration")
+	fs.DurationVar(&p.BuildStdDev, "build-stddev", 10*time.Minute, "standard deviation of check suite run durations")
+	fs.Float64Var(&p.FlakeRate, "flake-rate", 0.05, "probability of a check suite run failing spuriously")
+	fs.Float64Var(&p.FailureRate, "failure-rate", 0.1, "probability of a pull request being broken")
+	fs.DurationVar(&p.SampleInterval, "sample-interval", 6*time.Hour, "queue length sampling interval")
+	fs.Int64Var(&p.Seed, "seed", 1, "pseudo-random number generator seed")
+	configPath := fs.String("config", "", "yaml configuration file of the simulated repo")
+	strategy := fs.String("pipeline-strategy", "", "pipeline strategy, overrides the configuration file")
+	onErrPanic(fs.Parse(args))
+	if *configPath != "" {
+		p.Config = ReadConfig(*configPath)
+	}
+	if *strategy != "" {
+		p.Config.PipelineStrategy = PipelineStrategyName(*strategy)
+		onErrPanic(p.Config.Validate())
+	}
+	return p
+}
+
+// Simulate drives the StateMachine over simulated time against an in-memory
+// repo, in which pull requests get approved at random and in which check
+// suites pass or fail at random, and measures how the merge queue performs.
+// The StateMachine runs every time something happens in the repo: a pull
+// request gets approved or a check suite run completes.
+func Simulate(p SimulationParams) SimulationResult {
+	c := newSimGithubClient(p)
+	nextArrival := c.sampleArrival()
+	nextSample := time.Duration(0)
+	for {
+		next := nextSample
+		if nextArrival < next {
+			next = nextArrival
+		}
+		if end, ok := c.nextBuildEnd(); ok && end < next {
+			next = end
+		}
+		if next > p.Duration {
+			break
+		}
+		c.now = next
+		if c.now == nextArrival {
+			c.addPullRequest()
+			nextArrival = c.now + c.sampleArrival()
+		}
+		if c.now == nextSample {
+			c.result.QueueLength = append(c.result.QueueLength, QueueSample{Time: c.now, Length: c.queueLength()})
+			nextSample += p.SampleInterval
+		}
+		StateMachine(c, p.Config, c.now+time.Nanosecond, nil)
+	}
+	c.now = p.Duration
+	return c.finish()
+}
+
+// Report writes a human-readable summary of the simulation results.
+func (r SimulationResult) Report(w io.Writer) {
+	hours := r.Params.Duration.Hours()
+	fmt.Fprintf(w, "simulated %s, merge strategy: %s, pipeline strategy: %s\n",
+		r.Params.Duration, r.Params.Config.MergeStrategy, r.Params.Config.PipelineStrategy)
+	fmt.Fprintf(w, "pull requests: %d approved, %d merged, %d rejected, %d still queued\n",
+		r.Arrived, r.Merged, r.Rejected, r.Arrived-r.Merged-r.Rejected)
+	fmt.Fprintf(w, "throughput: %.2f merged per hour\n", float64(r.Merged)/hours)
+	if len(r.Latencies) > 0 {
+		fmt.Fprintf(w, "merge latency: p50 %s, p90 %s, p99 %s, max %s\n",
+			r.LatencyPercentile(50).Round(time.Second), r.LatencyPercentile(90).Round(time.Second),
+			r.LatencyPercentile(99).Round(time.Second), r.Latencies[len(r.Latencies)-1].Round(time.Second))
+	}
+	fmt.Fprintf(w, "check suite runs: %d started, %d cancelled\n", r.BuildsStarted, r.BuildsCancelled)
+	fmt.Fprintf(w, "CI time: %.1f hours", r.CITime.Hours())
+	if r.Merged > 0 {
+		fmt.Fprintf(w, ", %.1f hours per merged pull request", r.CITime.Hours()/float64(r.Merged))
+	}
+	fmt.Fprintln(w)
+	if r.BrokenMerged > 0 {
+		fmt.Fprintf(w, "WARNING: %d broken pull requests were merged\n", r.BrokenMerged)
+	}
+	fmt.Fprintln(w, "queue length over time:")
+	for _, s := range r.QueueLength {
+		fmt.Fprintf(w, "%10s %4d %s\n", s.Time, s.Length, strings.Repeat("#", s.Length))
+	}
+}
+
+// LatencyPercentile returns the given percentile of the merge latencies, using
+// the nearest-rank method.
+func (r SimulationResult) LatencyPercentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(r.Latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return r.Latencies[rank-1]
+}
+
+type simCommit struct {
+	parents []CommitID
+	// onto is the commit a merge candidate branch was created at, if the
+	// commit merges a batch of pull requests.
+	onto         CommitID
+	merged       []MergedPullRequest
+	pullRequests map[PullRequestNumber]struct{}
+}
+
+type simBuild struct {
+	start, end  time.Duration
+	isPass      bool
+	isCancelled bool
+}
+
+type simPullRequest struct {
+	approval time.Duration
+	isBroken bool
+	isClosed bool
+	isMerged bool
+}
+
+type simComment struct {
+	time time.Duration
+	PullRequestNumber
+	msg string
+}
+
+// simGithubClient implements GithubClient for simulations, in the same way as
+// TestGithubClient does for tests, but with a simulated clock and randomized
+// check suite outcomes.
+type simGithubClient struct {
+	params       SimulationParams
+	rng          *rand.Rand
+	now          time.Duration
+	base         CommitID
+	numCommits   int
+	commits      map[CommitID]simCommit
+	branches     map[BranchKey]CommitID
+	builds       map[CommitID]*simBuild
+	pullRequests map[PullRequestNumber]*simPullRequest
+	comments     []simComment
+	result       SimulationResult
+}
+
+var _ GithubClient = (*simGithubClient)(nil)
+
+func newSimGithubClient(p SimulationParams) *simGithubClient {
+	c := &simGithubClient{
+		params:       p,
+		rng:          rand.New(rand.NewSource(p.Seed)),
+		commits:      map[CommitID]simCommit{},
+		branches:     map[BranchKey]CommitID{},
+		builds:       map[CommitID]*simBuild{},
+		pullRequests: map[PullRequestNumber]*simPullRequest{},
+		result:       SimulationResult{Params: p},
+	}
+	c.base = c.newCommit(nil, map[PullRequestNumber]struct{}{})
+	return c
+}
+
+func (c *simGithubClient) GetBranch(bk BranchKey) BranchValue {
+	sha := c.branches[bk]
+	commit := c.commits[sha]
+	bv := BranchValue{
+		CommitID: sha,
+		Parents:  append([]CommitID{}, commit.parents...),
+		isValid:  len(commit.merged) > 0,
+	}
+	if bv.isValid {
+		bv.MergedPullRequests = append([]MergedPullRequest{}, commit.merged...)
+	}
+	if commit.onto != "" {
+		bv.Parents = []CommitID{commit.onto}
+	}
+	if b, ok := c.builds[sha]; ok && !b.isCancelled && b.end <= c.now {
+		bv.IsCheckDone = true
+		bv.IsCheckPass = b.isPass
+		pr := c.pullRequests[bk.PullRequestNumber]
+		// Batches which fail get bisected instead.
+		if !b.isPass && pr.isBroken && !pr.isClosed && len(commit.merged) == 1 {
+			// The author notices the failure and gives up.
+			pr.isClosed = true
+			c.result.Rejected++
+		}
+	}
+	return bv
+}
+
+func (c *simGithubClient) CreateBranch(bk BranchKey, sha CommitID) {
+	c.branches[bk] = sha
+}
+
+func (c *simGithubClient) DeleteBranch(bk BranchKey) {
+	sha := c.branches[bk]
+	delete(c.branches, bk)
+	for _, other := range c.branches {
+		if other == sha {
+			return
+		}
+	}
+	if b, ok := c.builds[sha]; ok && b.end > c.now && !b.isCancelled {
+		b.isCancelled = true
+		b.end = c.now
+		c.result.BuildsCancelled++
+	}
+}
+
+func (c *simGithubClient) MergeBranch(bk BranchKey, merged []MergedPullRequest) MergeResult {
+	head := c.branches[bk]
+	prs := map[PullRequestNumber]struct{}{}
+	for number := range c.commits[head].pullRequests {
+		prs[number] = struct{}{}
+	}
+	parents := []CommitID{head}
+	for _, pr := range merged {
+		prs[pr.Number] = struct{}{}
+		parents = append(parents, pr.Head)
+	}
+	sha := c.newCommit(parents, prs)
+	commit := c.commits[sha]
+	commit.merged = append([]MergedPullRequest{}, merged...)
+	if len(merged) > 1 {
+		commit.onto = head
+	}
+	c.commits[sha] = commit
+	c.branches[bk] = sha
+	b := &simBuild{
+		start:  c.now,
+		end:    c.now + c.sampleBuildDuration(),
+		isPass: c.rng.Float64() >= c.params.FlakeRate,
+	}
+	for number := range prs {
+		if c.pullRequests[number].isBroken {
+			b.isPass = false
+		}
+	}
+	c.builds[sha] = b
+	c.result.BuildsStarted++
+	return Merged
+}
+
+// Now returns the simulated time, as elapsed since the zero time.
+func (c *simGithubClient) Now() time.Time {
+	return time.Time{}.Add(c.now)
+}
+
+func (c *simGithubClient) GetBaseHead() CommitID {
+	return c.base
+}
+
+func (c *simGithubClient) FastForwardBase(old, sha CommitID) bool {
+	if c.base != old {
+		return false
+	}
+	c.base = sha
+	for number := range c.commits[sha].pullRequests {
+		pr := c.pullRequests[number]
+		if pr.isMerged {
+			continue
+		}
+		pr.isMerged = true
+		c.result.Merged++
+		c.result.Latencies = append(c.result.Latencies, c.now-pr.approval)
+		if pr.isBroken {
+			c.result.BrokenMerged++
+		}
+	}
+	return true
+}
+
+// IsFrozen returns false: the simulated merge queue never gets frozen.
+func (c *simGithubClient) IsFrozen() bool {
+	return false
+}
+
+func (c *simGithubClient) SetFrozen(bool) {}
+
+func (c *simGithubClient) GetPullRequest(_ context.Context, number PullRequestNumber) *PullRequest {
+	pr, ok := c.pullRequests[number]
+	if !ok {
+		return nil
+	}
+	return &PullRequest{
+		Number:      number,
+		Head:        simPRCommitID(number),
+		IsOpen:      !pr.isClosed && !pr.isMerged,
+		Approvals:   1,
+		IsCheckDone: true,
+		IsCheckPass: true,
+	}
+}
+
+func (c *simGithubClient) ListAllCommentsSince(duration time.Duration, fn func(number PullRequestNumber, msg, author string, createdAt time.Time)) {
+	for _, comment := range c.comments {
+		if comment.time >= c.now-duration {
+			// The comments are created in simulated time.
+			fn(comment.PullRequestNumber, comment.msg, "", time.Time{})
+		}
+	}
+}
+
+// IsMaintainer returns false: the simulated comments never freeze the merge
+// queue.
+func (c *simGithubClient) IsMaintainer(string) bool {
+	return false
+}
+
+func (c *simGithubClient) ListAllMergeCandidateBranches(fn func(bk BranchKey)) {
+	keys := make([]BranchKey, 0, len(c.branches))
+	for bk := range c.branches {
+		keys = append(keys, bk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	for _, bk := range keys {
+		fn(bk)
+	}
+}
+
+func (c *simGithubClient) PostComment(number PullRequestNumber, msg string) {
+	c.comments = append(c.comments, simComment{time: c.now, PullRequestNumber: number, msg: msg})
+}
+
+// GetDependencyStatus is never called, as simulated pull requests have no
+// dependencies.
+func (c *simGithubClient) GetDependencyStatus(ref PullRequestRef) DependencyStatus {
+	panic(fmt.Sprintf("unexpected dependency %s", ref))
+}
+
+// addPullRequest adds a new pull request and approves it for merging.
+func (c *simGithubClient) addPullRequest() {
+	number := PullRequestNumber(len(c.pullRequests) + 1)
+	c.pullRequests[number] = &simPullRequest{
+		approval: c.now,
+		isBroken: c.rng.Float64() < c.params.FailureRate,
+	}
+	c.commits[simPRCommitID(number)] = simCommit{}
+	c.PostComment(number, "bors merge")
+	c.result.Arrived++
+}
+
+// nextBuildEnd returns the earliest time in the future at which a check suite
+// run completes, if any.
+func (c *simGithubClient) nextBuildEnd() (end time.Duration, ok bool) {
+	for _, b := range c.builds {
+		if b.isCancelled || b.end <= c.now {
+			continue
+		}
+		if !ok || b.end < end {
+			end, ok = b.end, true
+		}
+	}
+	return end, ok
+}
+
+func (c *simGithubClient) queueLength() (n int) {
+	for _, pr := range c.pullRequests {
+		if !pr.isMerged && !pr.isClosed {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *simGithubClient) finish() SimulationResult {
+	for _, b := range c.builds {
+		end := b.end
+		if end > c.now {
+			end = c.now
+		}
+		c.result.CITime += end - b.start
+	}
+	sort.Slice(c.result.Latencies, func(i, j int) bool { return c.result.Latencies[i] < c.result.Latencies[j] })
+	return c.result
+}
+
+func (c *simGithubClient) newCommit(parents []CommitID, prs map[PullRequestNumber]struct{}) CommitID {
+	sha := CommitID(fmt.Sprintf("c%d", c.numCommits))
+	c.numCommits++
+	c.commits[sha] = simCommit{parents: parents, pullRequests: prs}
+	return sha
+}
+
+func (c *simGithubClient) sampleArrival() time.Duration {
+	return time.Duration(c.rng.ExpFloat64() / c.params.ArrivalRate * float64(time.Hour))
+}
+
+func (c *simGithubClient) sampleBuildDuration() time.Duration {
+	d := time.Duration(c.rng.NormFloat64()*float64(c.params.BuildStdDev)) + c.params.BuildMean
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+func simPRCommitID(number PullRequestNumber) CommitID {
+	return CommitID(fmt.Sprintf("pr-%d", number))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// TestSimulate runs a short simulation and checks that its results are
+// consistent and reproducible.
+func TestSimulate(t *testing.T) {
+	p := ParseSimulationParams([]string{"-duration=24h", "-arrival-rate=3", "-seed=42"})
+	r := Simulate(p)
+	require.Zero(t, r.BrokenMerged)
+	require.NotZero(t, r.Merged)
+	require.NotZero(t, r.Rejected)
+	require.LessOrEqual(t, r.Merged+r.Rejected, r.Arrived)
+	require.Len(t, r.Latencies, r.Merged)
+	require.True(t, r.LatencyPercentile(50) <= r.LatencyPercentile(99))
+	require.True(t, r.LatencyPercentile(50) >= 50*time.Minute)
+	require.Len(t, r.QueueLength, 5)
+	require.Equal(t, r, Simulate(p))
+}
@@ -1,11 +1,112 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
+// noticeMarkerRe matches the hidden line at the end of the comments posted on
+// pull requests by this tool, which identifies the kind of notice.
+// This allows to not post the same notice twice.
+var noticeMarkerRe = regexp.MustCompile(`^\s*<!-- merge-candidate: (.+) -->\s*$`)
+
+// borsMergeRe matches the comment lines which mark a pull request as to be
+// merged, optionally after the pull requests it depends on, see dependsOnRe.
+var borsMergeRe = regexp.MustCompile(`^\s*bors\s+(r\+|r=.*|merge|merge=.*)(\s+depends-on(=|\s+)\S+)*\s*$`)
+
+// approvedHeadRe matches the comment lines matched by borsMergeRe which name
+// the approved head of the pull request, as in "bors r=<sha>". The sha may be
+// abbreviated. Other values, such as reviewer logins, are ignored.
+var approvedHeadRe = regexp.MustCompile(`^\s*bors\s+(?:r|merge)=([0-9a-f]{7,40})(?:\s|$)`)
+
+// borsCancelRe matches the comment lines which cancel the merge of a pull
+// request.
+var borsCancelRe = regexp.MustCompile(`^\s*bors\s+(r-|merge-|cancel)\s*$`)
+
+// borsFreezeRe matches the comment lines which freeze or unfreeze the merge
+// queue of a base branch: either the one named in the comment, as in "bors
+// freeze release-23.1", or else the base branch of the pull request.
+var borsFreezeRe = regexp.MustCompile(`^\s*bors\s+(freeze|unfreeze)(?:\s+(\S+))?\s*$`)
+
+// dependsOnRe matches the pull requests which a pull request depends on, in
+// the comment lines matched by borsMergeRe, either in other repos or in the
+// same one. For instance: "bors merge depends-on=org/repo#123" or
+// "bors merge depends-on #123".
+var dependsOnRe = regexp.MustCompile(`\sdepends-on(?:=|\s+)(\S+)`)
+
+// approvalRevokedNotice is the kind of the notice posted on a pull request
+// whose head changed after it was approved. It has the same effect as a
+// "bors cancel" comment, until the pull request gets approved again.
+const approvalRevokedNotice = "approval revoked"
+
+// approvedNoticePrefix prefixes the kind of the notice posted on a pull request
+// when its approval is first processed, it is followed by the commit at the
+// head of the pull request then, which becomes the approved head unless the
+// approval names one.
+const approvedNoticePrefix = "approved "
+
+// blockedNoticePrefix prefixes the kind of the notices posted on pull requests
+// blocked by a merge rule, it is followed by the name of the rule.
+const blockedNoticePrefix = "blocked by "
+
+// mergeConflictNotice is the kind of the notice posted on pull requests which
+// couldn't be merged into a merge candidate branch off of the base branch.
+// They are blocked until they get approved again.
+const mergeConflictNotice = blockedNoticePrefix + "merge conflict"
+
+// mergeConflictReason is why pull requests with a mergeConflictNotice are
+// blocked.
+const mergeConflictReason = "it has merge conflicts"
+
+// freezeNotice and unfreezeNotice are the kinds of the notices posted on the
+// pull requests on which the merge queue was frozen or unfrozen with a "bors
+// freeze" or "bors unfreeze" comment, once done. freezeDeniedNotice is posted
+// instead if the author of the comment isn't an admin or a maintainer of the
+// repo. The kinds are followed by the base branch of the merge queue, see
+// freezeNoticeKind, as the pull request may belong to another one.
+const (
+	freezeNotice       = "freeze"
+	unfreezeNotice     = "unfreeze"
+	freezeDeniedNotice = "freeze denied"
+)
+
+// freezeNoticeKind returns the kind of a notice about the freeze of the merge
+// queue of the given base branch.
+func freezeNoticeKind(notice, base string) string {
+	return notice + " " + base
+}
+
+// freezeCommand is a "bors freeze" or "bors unfreeze" comment.
+type freezeCommand struct {
+	number PullRequestNumber
+	// kind is either freezeNotice or unfreezeNotice.
+	kind string
+	// base is the base branch named in the comment, if any.
+	base   string
+	author string
+}
+
+// frozenNotice is the kind of the notice posted on pull requests which would
+// have been merged if the base branch wasn't frozen.
+const frozenNotice = "frozen"
+
+// frozenReason and outsideMergeWindowsReason are why the base branch may be
+// frozen, see State.Freeze.
+const (
+	frozenReason              = "the merge queue is frozen"
+	outsideMergeWindowsReason = "it is outside of the merge windows"
+)
+
+// noticeMarker returns the hidden line identifying a kind of notice.
+func noticeMarker(kind string) string {
+	return "<!-- merge-candidate: " + kind + " -->"
+}
+
 // State stores the current state in the state machine.
 type State struct {
 	// Base is the commit at the head of the base branch, which is the branch
@@ -21,11 +122,60 @@ type State struct {
 	// comment.
 	// The map value is the commit at the head of the pull request branch.
 	MergeablePullRequests map[PullRequestNumber]CommitID
+	// ApprovalTimes is the time of the latest "bors r+" or "bors merge"
+	// comment on each of the mergeable pull requests, when known.
+	ApprovalTimes map[PullRequestNumber]time.Time
+	// ApprovedHeads is the commit at the head of each of the mergeable pull
+	// requests when it was approved: the one named in the approval, as in
+	// "bors r=<sha>", or else the one recorded in the notice posted when the
+	// approval was first processed, see approvedNoticePrefix. Pull requests
+	// whose current head differs weren't approved as such.
+	ApprovedHeads map[PullRequestNumber]CommitID
+	// PullRequestHeads is the commit at the head of each of the open pull
+	// requests which were fetched, whether they are mergeable or not, when
+	// known.
+	PullRequestHeads map[PullRequestNumber]CommitID
 	// CancelledPullRequests is the current set of pull requests for which
 	// a cancellation order has been emitted ("bors cancel" or "bors r-"), and
 	// which has not been superseded by a subsequent "bors r+" or "bors merge"
 	// comment.
 	CancelledPullRequests map[PullRequestNumber]struct{}
+	// BlockedPullRequests is the current set of pull requests which would be
+	// mergeable if they weren't blocked by one of the configured merge rules.
+	// The map value is the reason why the pull request is blocked.
+	BlockedPullRequests map[PullRequestNumber]string
+	// PendingPullRequests is the current set of pull requests for which github
+	// didn't determine in time whether they have merge conflicts.
+	PendingPullRequests map[PullRequestNumber]struct{}
+	// WaitingPullRequests is the current set of mergeable pull requests which
+	// depend on pull requests in other repos which are still to be merged
+	// ("bors merge depends-on=org/repo#123"). No merge candidate branches get
+	// created for these until then.
+	// Pull requests also wait for the open pull requests in the same repo
+	// which they depend on, as long as these aren't mergeable.
+	// The map value is the set of dependencies which are still to be merged.
+	WaitingPullRequests map[PullRequestNumber][]PullRequestRef
+	// StackedPullRequests is the current set of mergeable pull requests which
+	// depend on other mergeable pull requests in the same repo, either because
+	// they are stacked on them or because of "bors merge depends-on #123".
+	// Their merge candidate branches are only created on top of those of the
+	// pull requests they depend on.
+	// The map value is the set of mergeable pull requests they depend on.
+	StackedPullRequests map[PullRequestNumber][]PullRequestNumber
+	// PullRequestGroups is the fair share group of each of the mergeable pull
+	// requests which belong to one, see FairShare.
+	PullRequestGroups map[PullRequestNumber]string
+	// Freeze is why the base branch is frozen, empty if it isn't. While it is
+	// frozen, the base branch only gets fast-forwarded through the merge
+	// candidate branches of pull requests exempt from the freeze.
+	Freeze string
+	// FreezeExemptPullRequests is the current set of mergeable pull requests
+	// which have one of the freeze exempt labels.
+	FreezeExemptPullRequests map[PullRequestNumber]struct{}
+	// FrozenPullRequests is the current set of mergeable pull requests which
+	// have been notified since their approval that they won't be merged
+	// because the base branch is frozen.
+	FrozenPullRequests map[PullRequestNumber]struct{}
 }
 
 // PipelineValue is used to define PipelineTree and encodes the position of the
@@ -63,12 +213,19 @@ func FetchMergeCandidateBranchState(c GithubClient) State {
 // BuildPipelineTree builds a PipelineTree based off the current state.
 // See the PipelineTree type definition for more details.
 func (os State) BuildPipelineTree() PipelineTree {
+	return os.buildPipelineTree(os.Base)
+}
+
+// buildPipelineTree builds a PipelineTree of the merge candidate branches
+// based off of the given commit, which is usually the head of the base branch.
+func (os State) buildPipelineTree(base CommitID) PipelineTree {
 	t := make(PipelineTree, len(os.Branches))
 	shas := make(map[CommitID]BranchKey, len(os.Branches))
-	shas[os.Base] = BranchKey{}
+	shas[base] = BranchKey{}
 	for {
 		numAdded := 0
-		for bk, bv := range os.Branches {
+		for _, bk := range os.sortedBranchKeys() {
+			bv := os.Branches[bk]
 			if _, found := t[bk]; found {
 				continue
 			}
@@ -80,11 +237,19 @@ func (os State) BuildPipelineTree() PipelineTree {
 					break
 				}
 			}
+			if !bv.isValid && bv.CommitID == base {
+				// The merge failed right on top of the base branch.
+				parentKey, isInTree = BranchKey{}, true
+			}
 			if !isInTree {
 				continue
 			}
 			numAdded++
-			shas[bv.CommitID] = bk
+			if bv.isValid {
+				// Nothing gets built on top of a failed merge, whose head
+				// belongs to another branch or to the base branch.
+				shas[bv.CommitID] = bk
+			}
 			t[bk] = PipelineValue{
 				Predecessor:     parentKey,
 				IsNotInPipeline: t[parentKey].IsNotInPipeline || !bv.isValid || (bv.IsCheckDone && !bv.IsCheckPass),
@@ -98,11 +263,49 @@ func (os State) BuildPipelineTree() PipelineTree {
 	return t
 }
 
+// PreviousBase returns the commit off of which the merge candidate branches
+// were built, if the base branch was pushed to outside of the merge queue
+// since then, that is to say if none of the branches is based off of its head
+// any more. Returns an empty CommitID otherwise.
+// The branches may have been built off of several previous heads of the base
+// branch, in which case the one with the most branches is returned.
+func (os State) PreviousBase(t PipelineTree) CommitID {
+	if len(os.Branches) == 0 || len(t) > 0 {
+		return ""
+	}
+	heads := make(map[CommitID]struct{}, len(os.Branches))
+	for _, bv := range os.Branches {
+		if bv.isValid {
+			heads[bv.CommitID] = struct{}{}
+		}
+	}
+	if _, ok := heads[os.Base]; ok {
+		// The base branch was fast-forwarded to a merge candidate branch.
+		return ""
+	}
+	var previous CommitID
+	numBranches := 0
+	for _, bk := range os.sortedBranchKeys() {
+		bv := os.Branches[bk]
+		root := bv.CommitID
+		if bv.isValid && len(bv.Parents) > 0 {
+			root = bv.Parents[0]
+		}
+		if _, ok := heads[root]; ok {
+			continue
+		}
+		if n := len(os.buildPipelineTree(root)); n > numBranches {
+			previous, numBranches = root, n
+		}
+	}
+	return previous
+}
+
 // ToPrunedOrphanedBranches transitions the state to another in which all
 // orphaned merge candidate branches have been pruned.
 func (os State) ToPrunedOrphanedBranches(c GithubClient, t PipelineTree) State {
 	ns := deepCopy(os)
-	for bk := range ns.Branches {
+	for _, bk := range ns.sortedBranchKeys() {
 		if _, ok := t[bk]; !ok {
 			c.DeleteBranch(bk)
 			delete(ns.Branches, bk)
@@ -111,11 +314,153 @@ func (os State) ToPrunedOrphanedBranches(c GithubClient, t PipelineTree) State {
 	return ns
 }
 
+// ToRebuiltPipeline transitions the state to another in which the merge
+// candidate branches built off of the previous head of the base branch, see
+// PreviousBase, have been deleted, and in which those on the longest path
+// through their build pipeline have been rebuilt off of its current head,
+// one on top of the other. The queued pull requests keep their position
+// in the queue this way, the others are queued again after them.
+// A comment is posted on each of the pull requests to explain why.
+func (os State) ToRebuiltPipeline(c GithubClient, previousBase CommitID) State {
+	ns := deepCopy(os)
+	path := ns.buildPipelineTree(previousBase).longestPath()
+	isRebuilt := map[PullRequestNumber]bool{}
+	var batches [][]MergedPullRequest
+	for i := len(path) - 1; i >= 0; i-- {
+		var prs []MergedPullRequest
+		for _, number := range ns.Branches[path[i]].PullRequestNumbers(path[i]) {
+			if head, ok := ns.MergeablePullRequests[number]; ok && !isRebuilt[number] {
+				prs = append(prs, MergedPullRequest{Number: number, Head: head})
+				isRebuilt[number] = true
+			}
+		}
+		if len(prs) > 0 {
+			batches = append(batches, prs)
+		}
+	}
+	var affected []PullRequestNumber
+	for number := range ns.pullRequestsInBranches() {
+		affected = append(affected, number)
+	}
+	sort.Slice(affected, func(i, j int) bool { return affected[i] < affected[j] })
+	for _, bk := range ns.sortedBranchKeys() {
+		c.DeleteBranch(bk)
+		delete(ns.Branches, bk)
+	}
+	sha := ns.Base
+	isConflicting := map[PullRequestNumber]bool{}
+	for _, prs := range batches {
+		bk := BranchKey{PullRequestNumber: prs[0].Number, PipelineCounter: 1}
+		if result := createBranch(c, bk, sha, prs); result != Merged {
+			numbers := make([]PullRequestNumber, len(prs))
+			for i, pr := range prs {
+				numbers[i] = pr.Number
+				isRebuilt[pr.Number] = false
+				isConflicting[pr.Number] = result == MergeConflict && sha == ns.Base
+			}
+			if result == MergeConflict && sha == ns.Base {
+				reportMergeConflict(c, numbers)
+			}
+			continue
+		}
+		ns.Branches[bk] = c.GetBranch(bk)
+		sha = ns.Branches[bk].CommitID
+	}
+	for _, number := range affected {
+		if _, ok := ns.MergeablePullRequests[number]; !ok || isConflicting[number] {
+			continue
+		}
+		msg := "The base branch was pushed to outside of the merge queue, from %s to %s, " +
+			"the merge candidate branches of this pull request have been deleted. "
+		if isRebuilt[number] {
+			msg += "They have been rebuilt on top of the base branch, " +
+				"this pull request keeps its position in the queue."
+		} else {
+			msg += "This pull request has been queued again."
+		}
+		c.PostComment(number, fmt.Sprintf(msg, previousBase, ns.Base))
+	}
+	return ns
+}
+
 // FindFastForward identifies a commit to fast-foward to.
 // Returns nil if none was found.
 // There are several possible heuristics here, we chose to pick the one which
-// is in the longest pipeline path.
+// is in the longest pipeline path. While the base branch is frozen, we pick
+// the one furthest from the base branch among those which only merge pull
+// requests exempt from the freeze instead.
 func (os State) FindFastForward(t PipelineTree) *CommitID {
+	if os.Freeze != "" {
+		return os.findExemptFastForward(t)
+	}
+	for _, bk := range t.longestPath() {
+		if bv := os.Branches[bk]; bv.IsCheckPass {
+			return &bv.CommitID
+		}
+	}
+	return nil
+}
+
+// findExemptFastForward identifies a commit to fast-forward to while the base
+// branch is frozen, see FindFastForward.
+func (os State) findExemptFastForward(t PipelineTree) *CommitID {
+	var ff *CommitID
+	weight := 0
+	for _, bk := range t.sortedKeys() {
+		pv, bv := t[bk], os.Branches[bk]
+		if pv.IsNotInPipeline || !bv.IsCheckPass || pv.Weight <= weight {
+			continue
+		}
+		isExempt := true
+		for _, number := range os.pullRequestsOnPath(t, bk) {
+			if _, ok := os.FreezeExemptPullRequests[number]; !ok {
+				isExempt = false
+				break
+			}
+		}
+		if isExempt {
+			sha := bv.CommitID
+			ff, weight = &sha, pv.Weight
+		}
+	}
+	return ff
+}
+
+// NotifyFrozenPullRequests posts a notice on the pull requests which would be
+// merged if the base branch wasn't frozen, unless they were already notified.
+// Returns the numbers of these pull requests, which are held back by the
+// freeze.
+func (os State) NotifyFrozenPullRequests(c GithubClient, t PipelineTree) []PullRequestNumber {
+	if os.Freeze == "" {
+		return nil
+	}
+	unfrozen := os
+	unfrozen.Freeze = ""
+	ff := unfrozen.FindFastForward(t)
+	if ff == nil {
+		return nil
+	}
+	var held []PullRequestNumber
+	for _, bk := range os.FastForwardPath(t, *ff) {
+		for _, number := range os.Branches[bk].PullRequestNumbers(bk) {
+			if _, ok := os.FreezeExemptPullRequests[number]; ok {
+				continue
+			}
+			held = append(held, number)
+			if _, ok := os.FrozenPullRequests[number]; ok {
+				continue
+			}
+			c.PostComment(number, fmt.Sprintf(
+				"This pull request passed its checks but won't be merged until the freeze ends, because %s.\n\n%s",
+				os.Freeze, noticeMarker(frozenNotice)))
+		}
+	}
+	return held
+}
+
+// longestPath returns the keys of the branches on the longest path through
+// the build pipeline, from its head down to the base branch.
+func (t PipelineTree) longestPath() []BranchKey {
 	pipelineHead := BranchKey{}
 	for bk, pv := range t {
 		if pv.IsNotInPipeline {
@@ -123,20 +468,33 @@ func (os State) FindFastForward(t PipelineTree) *CommitID {
 		}
 		if t[pipelineHead].Weight < pv.Weight {
 			pipelineHead = bk
-		} else if t[pipelineHead].Weight == pv.Weight && pipelineHead.PullRequestNumber > bk.PullRequestNumber {
+		} else if t[pipelineHead].Weight == pv.Weight && bk.Less(pipelineHead) {
 			pipelineHead = bk
 		}
 	}
-	for {
-		bv, ok := os.Branches[pipelineHead]
-		if !ok {
-			return nil
+	var path []BranchKey
+	for bk := pipelineHead; bk != (BranchKey{}); bk = t[bk].Predecessor {
+		path = append(path, bk)
+	}
+	return path
+}
+
+// FastForwardPath returns the keys of the merge candidate branches on the path
+// through the pipeline tree from the base branch to the branch at the given
+// fast-forward target, in order. These are the branches which the base branch
+// gets fast-forwarded through.
+func (os State) FastForwardPath(t PipelineTree, sha CommitID) []BranchKey {
+	for _, target := range t.sortedKeys() {
+		if bv := os.Branches[target]; !bv.isValid || bv.CommitID != sha {
+			continue
 		}
-		if bv.IsCheckPass {
-			return &bv.CommitID
+		var path []BranchKey
+		for bk := target; bk != (BranchKey{}); bk = t[bk].Predecessor {
+			path = append([]BranchKey{bk}, path...)
 		}
-		pipelineHead = t[pipelineHead].Predecessor
+		return path
 	}
+	return nil
 }
 
 // ToDecoratedWithPullRequests transitions the state to another which is
@@ -145,115 +503,908 @@ func (os State) FindFastForward(t PipelineTree) *CommitID {
 // comments with the lines "bors merge" or "bors cancel" which mark the pull
 // requests as to be merged or as to cancel an ongoing merge attempt,
 // respectively.
-func (os State) ToDecoratedWithPullRequests(c GithubClient, commentsSince time.Duration) State {
-	borsMergeRe, err := regexp.Compile(`^\s*bors\s+(r\+|r=.*|merge|merge=.*)\s*$`)
-	if err != nil {
-		panic(err)
-	}
-	borsCancelRe, err := regexp.Compile(`^\s*bors\s+(r-|merge-|cancel)\s*$`)
-	if err != nil {
-		panic(err)
-	}
+// Pull requests which would otherwise be mergeable but don't satisfy the merge
+// rules are blocked instead, and a comment is posted on them explaining why,
+// unless the same rule already blocked them since they were last approved.
+// Pull requests for which github takes too long to determine whether they have
+// merge conflicts are pending, and are skipped.
+// Mergeable pull requests which depend on pull requests in other repos wait
+// for these to be merged. They are blocked if one of these got cancelled or
+// failed instead. Dependencies on pull requests in the same repo are resolved
+// once it is known which of those are mergeable, see StackedPullRequests.
+func (os State) ToDecoratedWithPullRequests(c GithubClient, cfg Config, commentsSince time.Duration) State {
 	ns := deepCopy(os)
 
 	numbers := make(map[PullRequestNumber]bool)
-	for bk := range ns.Branches {
-		numbers[bk.PullRequestNumber] = false
+	notices := make(map[PullRequestNumber]map[string]struct{})
+	approvalTimes := make(map[PullRequestNumber]time.Time)
+	approvedShas := make(map[PullRequestNumber]string)
+	recordedHeads := make(map[PullRequestNumber]CommitID)
+	dependencies := make(map[PullRequestNumber][]PullRequestRef)
+	// The "bors freeze" and "bors unfreeze" comments for this merge queue, or
+	// possibly for others if they don't name a base branch, since the latest
+	// one which was carried out or denied.
+	_, base := queueLabelsFor(c)
+	var freezeCommands []freezeCommand
+	for number := range ns.pullRequestsInBranches() {
+		numbers[number] = false
 	}
-	c.ListAllCommentsSince(commentsSince, func(number PullRequestNumber, msg string) {
+	c.ListAllCommentsSince(commentsSince, func(number PullRequestNumber, msg, author string, createdAt time.Time) {
 		for _, line := range strings.Split(msg, "\n") {
 			if borsMergeRe.MatchString(line) {
 				numbers[number] = false
+				delete(notices, number)
+				approvalTimes[number] = createdAt
+				approvedShas[number] = ""
+				delete(recordedHeads, number)
+				if m := approvedHeadRe.FindStringSubmatch(line); m != nil {
+					approvedShas[number] = m[1]
+				}
+				dependencies[number] = parseDependencies(line)
 			}
 			if borsCancelRe.MatchString(line) {
 				numbers[number] = true
 			}
+			if m := borsFreezeRe.FindStringSubmatch(line); m != nil && (m[2] == "" || m[2] == base) {
+				freezeCommands = append(freezeCommands, freezeCommand{number: number, kind: m[1], base: m[2], author: author})
+			}
+			if m := noticeMarkerRe.FindStringSubmatch(line); m != nil {
+				switch m[1] {
+				case freezeNoticeKind(freezeNotice, base), freezeNoticeKind(unfreezeNotice, base),
+					freezeNoticeKind(freezeDeniedNotice, base):
+					// The notice follows the latest command on the pull
+					// request, which superseded the earlier ones.
+					for i := len(freezeCommands) - 1; i >= 0; i-- {
+						if freezeCommands[i].number == number {
+							freezeCommands = freezeCommands[i+1:]
+							break
+						}
+					}
+				}
+				if notices[number] == nil {
+					notices[number] = map[string]struct{}{}
+				}
+				notices[number][m[1]] = struct{}{}
+				if m[1] == approvalRevokedNotice {
+					numbers[number] = true
+				}
+				if sha := strings.TrimPrefix(m[1], approvedNoticePrefix); sha != m[1] {
+					recordedHeads[number] = CommitID(sha)
+				}
+			}
 		}
 	})
 
+	if fc := latestFreezeCommand(c, cfg, freezeCommands); fc != nil && !c.IsMaintainer(fc.author) {
+		c.PostComment(fc.number, fmt.Sprintf(
+			"@%s can't `bors %s`: only admins and maintainers of the repo can freeze or unfreeze the merge queue.\n\n%s",
+			fc.author, fc.kind, noticeMarker(freezeNoticeKind(freezeDeniedNotice, base))))
+	} else if fc != nil {
+		ns.setFrozen(c, cfg, fc.number, fc.kind == freezeNotice, base)
+	}
+	if c.IsFrozen() {
+		ns.Freeze = frozenReason
+	} else if !cfg.IsInMergeWindow(c.Now()) {
+		ns.Freeze = outsideMergeWindowsReason
+	}
+
+	var uncancelled []PullRequestNumber
 	for number, isCancelled := range numbers {
 		if isCancelled {
 			ns.CancelledPullRequests[number] = struct{}{}
 		} else {
-			maybeCommitID := c.GetMergeablePullRequestHead(number)
-			if maybeCommitID != nil {
-				ns.MergeablePullRequests[number] = *maybeCommitID
+			uncancelled = append(uncancelled, number)
+		}
+	}
+	sort.Slice(uncancelled, func(i, j int) bool { return uncancelled[i] < uncancelled[j] })
+	block := func(number PullRequestNumber, kind, reason string) {
+		ns.BlockedPullRequests[number] = reason
+		if _, ok := notices[number][kind]; !ok {
+			c.PostComment(number, fmt.Sprintf(
+				"This pull request can't be merged because %s.\n\n%s", reason, noticeMarker(kind)))
+		}
+	}
+	sameRepoDependencies := make(map[PullRequestNumber][]PullRequestNumber)
+	prs := fetchPullRequests(c, cfg, uncancelled)
+	for i, number := range uncancelled {
+		pr := prs[i]
+		if pr != nil && pr.IsMergeabilityPending {
+			ns.PendingPullRequests[number] = struct{}{}
+		}
+		if pr != nil && (pr.IsOpen || pr.IsMergeabilityPending) && pr.Head != "" {
+			ns.PullRequestHeads[number] = pr.Head
+		}
+		if pr == nil || !pr.CanBeMerged() {
+			continue
+		}
+		if sha, ok := approvedShas[number]; ok && sha == "" && recordedHeads[number] == "" && !cfg.RequeueOnPush {
+			c.PostComment(number, fmt.Sprintf(
+				"Approved at %s: pushing to this pull request will revoke the approval.\n\n%s",
+				pr.Head, noticeMarker(approvedNoticePrefix+string(pr.Head))))
+			recordedHeads[number] = pr.Head
+		}
+		if rule, reason := cfg.MergeRules.Check(*pr); rule != "" {
+			block(number, blockedNoticePrefix+rule, reason)
+			continue
+		}
+		if _, ok := notices[number][mergeConflictNotice]; ok {
+			ns.BlockedPullRequests[number] = mergeConflictReason
+			continue
+		}
+		var otherRepoDependencies []PullRequestRef
+		for _, ref := range dependencies[number] {
+			if ref.Repo != "" {
+				otherRepoDependencies = append(otherRepoDependencies, ref)
+			} else if ref.Number != number {
+				sameRepoDependencies[number] = append(sameRepoDependencies[number], ref.Number)
 			}
 		}
+		if pr.StackedOn != 0 {
+			sameRepoDependencies[number] = append(sameRepoDependencies[number], pr.StackedOn)
+		}
+		waiting, ref, reason := checkDependencies(c, otherRepoDependencies)
+		if reason != "" {
+			block(number, blockedNoticePrefix+"dependency "+ref.String(), reason)
+			continue
+		}
+		if len(waiting) > 0 {
+			ns.WaitingPullRequests[number] = waiting
+		}
+		ns.MergeablePullRequests[number] = pr.Head
+		if group := cfg.FairShare.Group(*pr); group != "" {
+			ns.PullRequestGroups[number] = group
+		}
+		if hasAnyLabel(*pr, cfg.FreezeExemptLabels) {
+			ns.FreezeExemptPullRequests[number] = struct{}{}
+		}
+		if _, ok := notices[number][frozenNotice]; ok {
+			ns.FrozenPullRequests[number] = struct{}{}
+		}
+		if t := approvalTimes[number]; !t.IsZero() {
+			ns.ApprovalTimes[number] = t
+		}
+		ns.ApprovedHeads[number] = approvedHead(*pr, approvedShas[number], recordedHeads[number])
 	}
+	ns.resolveSameRepoDependencies(c, cfg, sameRepoDependencies, block)
 
 	return ns
 }
 
-// ToPrunedCancelledPullRequests transitions the state to another in which
-// the merge candidate branches for cancelled pull requests have been deleted.
-func (os State) ToPrunedCancelledPullRequests(c GithubClient) State {
+// approvedHead returns the commit at the head of a mergeable pull request when
+// it was approved, see ApprovedHeads, given the sha named in the approval if
+// any, and the head recorded when the approval was processed if any.
+func approvedHead(pr PullRequest, sha string, recorded CommitID) CommitID {
+	switch {
+	case sha != "" && !strings.HasPrefix(string(pr.Head), sha):
+		return CommitID(sha)
+	case sha == "" && recorded != "":
+		return recorded
+	}
+	return pr.Head
+}
+
+// latestFreezeCommand returns the latest of the freeze commands which is for
+// the merge queue, nil if there is none. Those which don't name a base branch
+// are for the merge queue of the base branch of their pull request.
+func latestFreezeCommand(c GithubClient, cfg Config, commands []freezeCommand) *freezeCommand {
+	for i := len(commands) - 1; i >= 0; i-- {
+		if commands[i].base != "" {
+			return &commands[i]
+		}
+		pr := fetchPullRequests(c, cfg, []PullRequestNumber{commands[i].number})[0]
+		if pr != nil && !pr.IsForOtherBase {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// setFrozen freezes or unfreezes the merge queue of the base branch following
+// a "bors freeze" or "bors unfreeze" comment on a pull request, on which it
+// posts a notice.
+func (ns State) setFrozen(c GithubClient, cfg Config, number PullRequestNumber, frozen bool, base string) {
+	c.SetFrozen(frozen)
+	if !frozen {
+		c.PostComment(number, "The merge queue is unfrozen.\n\n"+noticeMarker(freezeNoticeKind(unfreezeNotice, base)))
+		return
+	}
+	exempt := ""
+	if len(cfg.FreezeExemptLabels) > 0 {
+		exempt = fmt.Sprintf(", except through pull requests with the %s label", labelList(cfg.FreezeExemptLabels))
+	}
+	c.PostComment(number, fmt.Sprintf(
+		"The merge queue is frozen: the base branch won't be fast-forwarded until `bors unfreeze`%s. "+
+			"Merge candidate branches keep getting built in the meantime.\n\n%s",
+		exempt, noticeMarker(freezeNoticeKind(freezeNotice, base))))
+}
+
+// hasAnyLabel returns true iff the pull request has one of the labels.
+func hasAnyLabel(pr PullRequest, labels []string) bool {
+	for _, label := range pr.Labels {
+		for _, l := range labels {
+			if label == l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// labelList formats labels for comments, as in "`a` or `b`".
+func labelList(labels []string) string {
+	quoted := make([]string, len(labels))
+	for i, label := range labels {
+		quoted[i] = "`" + label + "`"
+	}
+	return strings.Join(quoted, " or ")
+}
+
+// resolveSameRepoDependencies blocks the mergeable pull requests which depend
+// on cancelled or blocked pull requests in the same repo, which may block the
+// ones which depend on these in turn. The others either wait for the pull
+// requests they depend on, if these are open but not mergeable, or get stacked
+// on them, if they are mergeable.
+func (ns State) resolveSameRepoDependencies(
+	c GithubClient,
+	cfg Config,
+	dependencies map[PullRequestNumber][]PullRequestNumber,
+	block func(number PullRequestNumber, kind, reason string),
+) {
+	var numbers []PullRequestNumber
+	for number := range dependencies {
+		numbers = append(numbers, number)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	for isChanged := true; isChanged; {
+		isChanged = false
+		for _, number := range numbers {
+			if _, ok := ns.MergeablePullRequests[number]; !ok {
+				continue
+			}
+			for _, dep := range dependencies[number] {
+				ref := PullRequestRef{Number: dep}
+				reason := ""
+				if _, ok := ns.CancelledPullRequests[dep]; ok {
+					reason = fmt.Sprintf("its dependency %s was cancelled", ref)
+				} else if _, ok := ns.BlockedPullRequests[dep]; ok {
+					reason = fmt.Sprintf("its dependency %s is blocked", ref)
+				}
+				if reason != "" {
+					delete(ns.MergeablePullRequests, number)
+					delete(ns.ApprovalTimes, number)
+					delete(ns.ApprovedHeads, number)
+					delete(ns.WaitingPullRequests, number)
+					block(number, blockedNoticePrefix+"dependency "+ref.String(), reason)
+					isChanged = true
+					break
+				}
+			}
+		}
+	}
+
+	// Fetch the dependencies which aren't mergeable, to find out whether
+	// these are still open.
+	var unmergeable []PullRequestNumber
+	isFetched := map[PullRequestNumber]bool{}
+	for _, number := range numbers {
+		if _, ok := ns.MergeablePullRequests[number]; !ok {
+			continue
+		}
+		for _, dep := range dependencies[number] {
+			if _, ok := ns.MergeablePullRequests[dep]; !ok && !isFetched[dep] {
+				unmergeable = append(unmergeable, dep)
+				isFetched[dep] = true
+			}
+		}
+	}
+	sort.Slice(unmergeable, func(i, j int) bool { return unmergeable[i] < unmergeable[j] })
+	isOpen := map[PullRequestNumber]bool{}
+	for i, pr := range fetchPullRequests(c, cfg, unmergeable) {
+		isOpen[unmergeable[i]] = pr != nil && pr.IsOpen
+	}
+	for _, number := range numbers {
+		if _, ok := ns.MergeablePullRequests[number]; !ok {
+			continue
+		}
+		for _, dep := range dependencies[number] {
+			if _, ok := ns.MergeablePullRequests[dep]; ok {
+				ns.StackedPullRequests[number] = append(ns.StackedPullRequests[number], dep)
+			} else if isOpen[dep] {
+				ns.WaitingPullRequests[number] = append(ns.WaitingPullRequests[number], PullRequestRef{Number: dep})
+			}
+		}
+	}
+}
+
+// parseDependencies returns the pull requests which a pull request depends on,
+// according to a comment line matched by borsMergeRe.
+// Invalid references are ignored.
+func parseDependencies(line string) []PullRequestRef {
+	var refs []PullRequestRef
+	for _, m := range dependsOnRe.FindAllStringSubmatch(line, -1) {
+		if ref, ok := ParsePullRequestRef(m[1]); ok {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// checkDependencies fetches the status of the dependencies of a pull request
+// in other repos, and returns those which are still to be merged. If one of
+// them was cancelled, failed or is invalid instead, it is returned along with
+// the reason why the pull request is blocked.
+func checkDependencies(c GithubClient, refs []PullRequestRef) (waiting []PullRequestRef, ref PullRequestRef, reason string) {
+	for _, dep := range refs {
+		switch c.GetDependencyStatus(dep) {
+		case DependencyPending:
+			waiting = append(waiting, dep)
+		case DependencyCancelled:
+			return nil, dep, fmt.Sprintf("its dependency %s was cancelled", dep)
+		case DependencyFailed:
+			return nil, dep, fmt.Sprintf("the check suites of its dependency %s failed", dep)
+		case DependencyInvalid:
+			return nil, dep, fmt.Sprintf("its dependency %s doesn't exist or isn't accessible", dep)
+		}
+	}
+	return waiting, PullRequestRef{}, ""
+}
+
+// fetchPullRequests concurrently fetches the pull requests with the given
+// numbers, within the mergeability timeout. The results are in the same order.
+// A panic while fetching any of them, such as on a github API error, is
+// raised again in the calling goroutine once all of them are done.
+func fetchPullRequests(c GithubClient, cfg Config, numbers []PullRequestNumber) []*PullRequest {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.MergeabilityTimeout)
+	defer cancel()
+	prs := make([]*PullRequest, len(numbers))
+	sem := make(chan struct{}, cfg.MaxConcurrentRequests)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var panicked interface{}
+	for i, number := range numbers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, number PullRequestNumber) {
+			defer func() {
+				if r := recover(); r != nil {
+					mu.Lock()
+					if panicked == nil {
+						panicked = r
+					}
+					mu.Unlock()
+				}
+				<-sem
+				wg.Done()
+			}()
+			prs[i] = c.GetPullRequest(ctx, number)
+		}(i, number)
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+	return prs
+}
+
+// ToRecoveredBranches transitions the state to another in which the merge
+// candidate branches which are incomplete have been either completed or
+// deleted. A branch is incomplete if it is still at the commit at which it was
+// created, the base branch or another merge candidate branch, because the
+// process was interrupted before the pull request got merged into it.
+// Such a branch gets completed if its pull request is still mergeable, with
+// its current head. Since the batch it belonged to is unknown, the other pull
+// requests of the batch are left in the queue. Other invalid branches are
+// deleted, and if the merge of the pull request conflicts off of the base
+// branch, the merge conflict is reported.
+func (os State) ToRecoveredBranches(c GithubClient) State {
+	ns := deepCopy(os)
+	heads := map[CommitID]struct{}{ns.Base: {}}
+	for _, bv := range ns.Branches {
+		if bv.isValid {
+			heads[bv.CommitID] = struct{}{}
+		}
+	}
+	for _, bk := range ns.sortedBranchKeys() {
+		bv := ns.Branches[bk]
+		if bv.isValid {
+			continue
+		}
+		head, isMergeable := ns.MergeablePullRequests[bk.PullRequestNumber]
+		if _, isIncomplete := heads[bv.CommitID]; isIncomplete && isMergeable {
+			prs := []MergedPullRequest{{Number: bk.PullRequestNumber, Head: head}}
+			result := c.MergeBranch(bk, prs)
+			if result == Merged {
+				ns.Branches[bk] = c.GetBranch(bk)
+				continue
+			}
+			if result == MergeConflict && bv.CommitID == ns.Base {
+				reportMergeConflict(c, []PullRequestNumber{bk.PullRequestNumber})
+				ns.BlockedPullRequests[bk.PullRequestNumber] = mergeConflictReason
+				delete(ns.MergeablePullRequests, bk.PullRequestNumber)
+			}
+		}
+		c.DeleteBranch(bk)
+		delete(ns.Branches, bk)
+	}
+	return ns
+}
+
+// ToPrunedStalePullRequests transitions the state to another in which the
+// merge candidate branches of the pull requests whose head changed since they
+// were approved have been deleted. These are the pull requests whose head
+// differs from the one merged into any of their branches, whether they are
+// still mergeable or not, and the mergeable pull requests whose head differs
+// from the approved one, see ApprovedHeads.
+// If requeueOnPush is set, these pull requests remain mergeable with their
+// new head, whatever the approved one. Otherwise, they are no longer mergeable
+// and a comment is posted on each of them to require a new approval.
+func (os State) ToPrunedStalePullRequests(c GithubClient, requeueOnPush bool) State {
 	ns := deepCopy(os)
-	for bk := range ns.Branches {
-		if _, ok := ns.CancelledPullRequests[bk.PullRequestNumber]; ok {
+	approved := map[PullRequestNumber]CommitID{}
+	for number, head := range ns.MergeablePullRequests {
+		if approvedHead, ok := ns.ApprovedHeads[number]; ok && approvedHead != head && !requeueOnPush {
+			approved[number] = approvedHead
+		}
+	}
+	for _, bk := range ns.sortedBranchKeys() {
+		bv := ns.Branches[bk]
+		if !bv.isValid {
+			continue
+		}
+		isStale := false
+		for _, pr := range bv.MergedPullRequests {
+			head, ok := ns.PullRequestHeads[pr.Number]
+			if _, isApprovalStale := approved[pr.Number]; !isApprovalStale && (!ok || pr.Head == head) {
+				continue
+			}
+			isStale = true
+			if approvedHead, found := approved[pr.Number]; !found || approvedHead == "" {
+				approved[pr.Number] = pr.Head
+			}
+		}
+		if isStale {
 			c.DeleteBranch(bk)
 			delete(ns.Branches, bk)
 		}
 	}
+	if requeueOnPush {
+		return ns
+	}
+	stale := make([]PullRequestNumber, 0, len(approved))
+	for number := range approved {
+		stale = append(stale, number)
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i] < stale[j] })
+	for _, number := range stale {
+		change := "changed"
+		if approved[number] != "" {
+			change = fmt.Sprintf("changed from %s", approved[number])
+		}
+		if head := ns.PullRequestHeads[number]; head != "" {
+			change += fmt.Sprintf(" to %s", head)
+		}
+		c.PostComment(number, fmt.Sprintf(
+			"The head of this pull request %s after it was approved, "+
+				"its merge candidate branches have been deleted. "+
+				"It needs to be approved again with `bors merge`.\n\n%s",
+			change, noticeMarker(approvalRevokedNotice)))
+		delete(ns.MergeablePullRequests, number)
+	}
+	return ns
+}
+
+// ToPrunedCancelledPullRequests transitions the state to another in which
+// the merge candidate branches for cancelled or blocked pull requests have
+// been deleted.
+func (os State) ToPrunedCancelledPullRequests(c GithubClient) State {
+	ns := deepCopy(os)
+	for _, bk := range ns.sortedBranchKeys() {
+		for _, number := range ns.Branches[bk].PullRequestNumbers(bk) {
+			_, isCancelled := ns.CancelledPullRequests[number]
+			_, isBlocked := ns.BlockedPullRequests[number]
+			if isCancelled || isBlocked {
+				c.DeleteBranch(bk)
+				delete(ns.Branches, bk)
+				break
+			}
+		}
+	}
 	ns.CancelledPullRequests = nil
 	return ns
 }
 
 // NextMergeablePullRequest returns the number of a pull request for which
-// merge candidate branches could be created. Returns 0 if none is available.
+// merge candidate branches could be created in the given pipeline tree.
+// Returns 0 if none is available.
 // There are several possible heuristics here, we chose to pick the one with
-// the smallest number, as this often corresponds to the oldest pull request.
-func (os State) NextMergeablePullRequest() PullRequestNumber {
-	numbersInBranches := map[PullRequestNumber]struct{}{}
-	for bk := range os.Branches {
-		numbersInBranches[bk.PullRequestNumber] = struct{}{}
+// the smallest number, as this often corresponds to the oldest pull request,
+// within the fair share group with the fewest pull requests in the build
+// pipeline, see fairShareOrder.
+func (os State) NextMergeablePullRequest(t PipelineTree) PullRequestNumber {
+	numbers := os.NextMergeablePullRequests(t, 1, true)
+	if len(numbers) == 0 {
+		return 0
 	}
-	var nextNumber PullRequestNumber
+	return numbers[0]
+}
+
+// NextMergeablePullRequests returns the numbers of up to n pull requests for
+// which merge candidate branches could be created as a batch, in the order in
+// which NextMergeablePullRequest would pick them. Pull requests which wait for
+// their dependencies to be merged are skipped. So are stacked pull requests,
+// unless the pull requests they depend on are in the batch before them, or, if
+// speculative is set, in a branch of the build pipeline, see
+// CreateBranchesForBatch.
+func (os State) NextMergeablePullRequests(t PipelineTree, n int, speculative bool) []PullRequestNumber {
+	numbersInBranches := os.pullRequestsInBranches()
+	var candidates []PullRequestNumber
 	for number := range os.MergeablePullRequests {
-		if _, found := numbersInBranches[number]; found {
+		_, found := numbersInBranches[number]
+		_, isWaiting := os.WaitingPullRequests[number]
+		if !found && !isWaiting {
+			candidates = append(candidates, number)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	var numbers []PullRequestNumber
+	for _, number := range os.fairShareOrder(t, candidates) {
+		if len(numbers) == n {
+			break
+		}
+		batch := append(append([]PullRequestNumber{}, numbers...), number)
+		if len(os.missingDependencies(batch)) > 0 && (!speculative || len(os.stackingBranches(t, batch)) == 0) {
 			continue
 		}
-		if nextNumber == 0 || nextNumber > number {
-			nextNumber = number
+		numbers = batch
+	}
+	return numbers
+}
+
+// fairShareOrder orders candidate pull requests, sorted by number, by taking
+// turns between their fair share groups: each turn goes to the group with the
+// fewest pull requests in the build pipeline or picked in earlier turns, or
+// in case of a tie to the one with the smallest candidate left, which gets
+// picked.
+func (os State) fairShareOrder(t PipelineTree, candidates []PullRequestNumber) []PullRequestNumber {
+	if len(os.PullRequestGroups) == 0 {
+		return candidates
+	}
+	inPipeline := map[PullRequestNumber]struct{}{}
+	for bk, pv := range t {
+		if !pv.IsNotInPipeline {
+			for _, number := range os.Branches[bk].PullRequestNumbers(bk) {
+				inPipeline[number] = struct{}{}
+			}
 		}
 	}
-	return nextNumber
+	shares := map[string]int{}
+	for number := range inPipeline {
+		shares[os.PullRequestGroups[number]]++
+	}
+	var groups []string
+	queues := map[string][]PullRequestNumber{}
+	for _, number := range candidates {
+		group := os.PullRequestGroups[number]
+		if _, ok := queues[group]; !ok {
+			groups = append(groups, group)
+		}
+		queues[group] = append(queues[group], number)
+	}
+	ordered := make([]PullRequestNumber, 0, len(candidates))
+	for len(ordered) < len(candidates) {
+		next := ""
+		for _, group := range groups {
+			if len(queues[group]) == 0 {
+				continue
+			}
+			if len(queues[next]) == 0 || shares[group] < shares[next] ||
+				(shares[group] == shares[next] && queues[group][0] < queues[next][0]) {
+				next = group
+			}
+		}
+		ordered = append(ordered, queues[next][0])
+		queues[next] = queues[next][1:]
+		shares[next]++
+	}
+	return ordered
 }
 
 // CreateBranchesForPullRequest transitions the state to another (implicit)
 // state in which new merge candidate branches have been created for a mergeable
 // pull request.
 // There are several possible heuristics here, we chose to create branches based
-// off of all commits in the build pipeline tree, as well as a branch off of the
+// off of all commits in the build pipeline tree, or of at most
+// maxSpeculativeBranches of them if it is positive, as well as a branch off of
 // the base branch.
-func (os State) CreateBranchesForPullRequest(c GithubClient, t PipelineTree, number PullRequestNumber) {
-	bk := BranchKey{
-		PullRequestNumber: number,
-		PipelineCounter:   1,
+func (os State) CreateBranchesForPullRequest(c GithubClient, t PipelineTree, number PullRequestNumber, maxSpeculativeBranches int) {
+	os.CreateBranchesForBatch(c, t, []PullRequestNumber{number}, true, maxSpeculativeBranches)
+}
+
+// CreateBranchesForBatch transitions the state to another (implicit) state in
+// which new merge candidate branches have been created for a batch of
+// mergeable pull requests, which get merged in the given order.
+// A branch is created off of the base branch and, if speculative is set, off
+// of all commits in the build pipeline tree as well, or off of the
+// maxSpeculativeBranches closest to the head of the build pipeline if it is
+// positive. Stacked pull requests can't be built without the pull requests
+// they depend on: unless these are in the batch, branches are only created off
+// of the commits in the build pipeline tree which contain them. If the head of
+// a pull request of the batch changed since it was fetched, no more branches
+// are created for the batch, see MergeStaleHead.
+func (os State) CreateBranchesForBatch(c GithubClient, t PipelineTree, batch []PullRequestNumber, speculative bool, maxSpeculativeBranches int) {
+	prs := make([]MergedPullRequest, len(batch))
+	for i, number := range batch {
+		head, ok := os.MergeablePullRequests[number]
+		if !ok {
+			return
+		}
+		prs[i] = MergedPullRequest{Number: number, Head: head}
+	}
+	bk := BranchKey{PullRequestNumber: batch[0]}
+	for existing := range os.Branches {
+		if existing.PullRequestNumber == bk.PullRequestNumber && existing.PipelineCounter > bk.PipelineCounter {
+			bk.PipelineCounter = existing.PipelineCounter
+		}
 	}
-	pullRequestHead, ok := os.MergeablePullRequests[bk.PullRequestNumber]
-	if !ok {
+	isCreated, isConflict := false, false
+	if len(os.missingDependencies(batch)) == 0 {
+		bk.PipelineCounter++
+		switch createBranch(c, bk, os.Base, prs) {
+		case Merged:
+			isCreated = true
+		case MergeConflict:
+			isConflict = true
+		case MergeStaleHead:
+			// The next run of the state machine picks up the new head.
+			return
+		}
+	}
+	if !speculative {
+		if isConflict {
+			reportMergeConflict(c, batch)
+		}
 		return
 	}
-	c.CreateBranch(bk, os.Base)
-	c.MergeBranch(bk, pullRequestHead)
-	for pk, pv := range t {
-		if pv.IsNotInPipeline {
+	// Work out which pull requests ahead in the queue the batch conflicts
+	// with: those in the paths of the branches off of which the merge failed,
+	// but in none of those off of which it succeeded.
+	failed := map[BranchKey]bool{}
+	isInSuccess := map[PullRequestNumber]bool{}
+	var inFailure []PullRequestNumber
+	for _, pk := range t.closestToHead(os.stackingBranches(t, batch), maxSpeculativeBranches) {
+		isOnFailedPath := false
+		for ak := pk; ak != (BranchKey{}); ak = t[ak].Predecessor {
+			isOnFailedPath = isOnFailedPath || failed[ak]
+		}
+		if isOnFailedPath {
+			// Don't bother with merges which would fail in the same way.
 			continue
 		}
 		bk.PipelineCounter++
-		c.CreateBranch(bk, os.Branches[pk].CommitID)
-		c.MergeBranch(bk, pullRequestHead)
+		path := os.pullRequestsOnPath(t, pk)
+		switch createBranch(c, bk, os.Branches[pk].CommitID, prs) {
+		case Merged:
+			isCreated = true
+			for _, number := range path {
+				isInSuccess[number] = true
+			}
+		case MergeConflict:
+			failed[pk] = true
+			inFailure = append(inFailure, path...)
+		case MergeStaleHead:
+			return
+		}
+	}
+	if isConflict || !isCreated {
+		reportMergeConflict(c, batch)
+		return
+	}
+	var culprits []PullRequestNumber
+	isCulprit := map[PullRequestNumber]bool{}
+	for _, number := range inFailure {
+		if !isInSuccess[number] && !isCulprit[number] {
+			culprits = append(culprits, number)
+			isCulprit[number] = true
+		}
+	}
+	if len(culprits) > 0 {
+		reportPredecessorConflict(c, batch, culprits)
+	}
+}
+
+// pullRequestsOnPath returns the pull requests merged into the merge candidate
+// branches on the path through the pipeline tree from the base branch to the
+// given branch, in order.
+func (os State) pullRequestsOnPath(t PipelineTree, pk BranchKey) []PullRequestNumber {
+	var numbers []PullRequestNumber
+	for bk := pk; bk != (BranchKey{}); bk = t[bk].Predecessor {
+		numbers = append(os.Branches[bk].PullRequestNumbers(bk), numbers...)
+	}
+	return numbers
+}
+
+// reportPredecessorConflict posts a comment on the pull requests of a batch
+// which conflict with pull requests ahead of them in the queue. The merge
+// candidate branches built off of these are skipped, the others remain.
+func reportPredecessorConflict(c GithubClient, batch, culprits []PullRequestNumber) {
+	verb := "is"
+	if len(culprits) > 1 {
+		verb = "are"
+	}
+	for _, number := range batch {
+		c.PostComment(number, fmt.Sprintf(
+			"This pull request conflicts with %s which %s ahead of you in the queue. "+
+				"It will only be merged if %s doesn't get merged first.",
+			pullRequestList(culprits), verb, pullRequestList(culprits)))
+	}
+}
+
+// createBranch creates a merge candidate branch at the given commit, and
+// merges the given pull requests into it. If the merge fails, the branch is
+// deleted rather than left as it was created. Returns the result of the merge.
+func createBranch(c GithubClient, bk BranchKey, sha CommitID, prs []MergedPullRequest) MergeResult {
+	c.CreateBranch(bk, sha)
+	result := c.MergeBranch(bk, prs)
+	if result != Merged {
+		c.DeleteBranch(bk)
+	}
+	return result
+}
+
+// reportMergeConflict posts a comment on the pull requests of a batch which
+// couldn't be merged into a merge candidate branch off of the base branch, or
+// into any merge candidate branch at all. These are blocked until they get
+// approved again, see mergeConflictNotice.
+func reportMergeConflict(c GithubClient, batch []PullRequestNumber) {
+	for _, number := range batch {
+		reason := mergeConflictReason + " with the base branch"
+		var others []PullRequestNumber
+		for _, other := range batch {
+			if other != number {
+				others = append(others, other)
+			}
+		}
+		if len(others) > 0 {
+			reason += " when merged together with " + pullRequestList(others)
+		}
+		c.PostComment(number, fmt.Sprintf(
+			"This pull request can't be merged because %s. "+
+				"It needs to be approved again with `bors merge` once these are resolved.\n\n%s",
+			reason, noticeMarker(mergeConflictNotice)))
+	}
+}
+
+// pullRequestList returns the references to the given pull requests, such as
+// "#1, #2 and #3".
+func pullRequestList(numbers []PullRequestNumber) string {
+	refs := make([]string, len(numbers))
+	for i, number := range numbers {
+		refs[i] = PullRequestRef{Number: number}.String()
+	}
+	if len(refs) == 1 {
+		return refs[0]
 	}
+	return strings.Join(refs[:len(refs)-1], ", ") + " and " + refs[len(refs)-1]
+}
+
+// missingDependencies returns the pull requests which the stacked pull
+// requests in a batch depend on, and which are not in the batch before them.
+func (os State) missingDependencies(batch []PullRequestNumber) []PullRequestNumber {
+	var missing []PullRequestNumber
+	isBefore := map[PullRequestNumber]bool{}
+	for _, number := range batch {
+		for _, dep := range os.StackedPullRequests[number] {
+			if !isBefore[dep] {
+				missing = append(missing, dep)
+			}
+		}
+		isBefore[number] = true
+	}
+	return missing
+}
+
+// stackingBranches returns the keys of the merge candidate branches in the
+// build pipeline tree off of which a batch can be built, in order: those which
+// contain the pull requests which the batch is missing, if any, see
+// missingDependencies.
+func (os State) stackingBranches(t PipelineTree, batch []PullRequestNumber) []BranchKey {
+	missing := os.missingDependencies(batch)
+	var keys []BranchKey
+	for _, pk := range t.sortedKeys() {
+		if t[pk].IsNotInPipeline {
+			continue
+		}
+		contained := map[PullRequestNumber]struct{}{}
+		for _, number := range os.pullRequestsOnPath(t, pk) {
+			contained[number] = struct{}{}
+		}
+		isStackable := true
+		for _, dep := range missing {
+			if _, ok := contained[dep]; !ok {
+				isStackable = false
+				break
+			}
+		}
+		if isStackable {
+			keys = append(keys, pk)
+		}
+	}
+	return keys
+}
+
+// closestToHead returns up to n of the given keys of the pipeline tree, or all
+// of them if n isn't positive, preferring those with the greatest weight, in
+// the same order.
+func (t PipelineTree) closestToHead(keys []BranchKey, n int) []BranchKey {
+	if n <= 0 || len(keys) <= n {
+		return keys
+	}
+	byWeight := append([]BranchKey(nil), keys...)
+	sort.SliceStable(byWeight, func(i, j int) bool { return t[byWeight[i]].Weight > t[byWeight[j]].Weight })
+	kept := make(map[BranchKey]bool, n)
+	for _, bk := range byWeight[:n] {
+		kept[bk] = true
+	}
+	var ret []BranchKey
+	for _, bk := range keys {
+		if kept[bk] {
+			ret = append(ret, bk)
+		}
+	}
+	return ret
+}
+
+// pullRequestsInBranches returns the set of pull requests which are merged
+// into at least one merge candidate branch.
+func (os State) pullRequestsInBranches() map[PullRequestNumber]struct{} {
+	numbers := map[PullRequestNumber]struct{}{}
+	for bk, bv := range os.Branches {
+		for _, number := range bv.PullRequestNumbers(bk) {
+			numbers[number] = struct{}{}
+		}
+	}
+	return numbers
+}
+
+// sortedBranchKeys returns the keys of the merge candidate branches in the
+// state, sorted according to BranchKey.Less, to keep transitions deterministic.
+func (os State) sortedBranchKeys() []BranchKey {
+	keys := make([]BranchKey, 0, len(os.Branches))
+	for bk := range os.Branches {
+		keys = append(keys, bk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return keys
+}
+
+// sortedKeys returns the keys of the pipeline tree, sorted according to
+// BranchKey.Less.
+func (t PipelineTree) sortedKeys() []BranchKey {
+	keys := make([]BranchKey, 0, len(t))
+	for bk := range t {
+		keys = append(keys, bk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Less(keys[j]) })
+	return keys
 }
 
 // fresh returns an empty state, with memory pre-allocated according to the
 // given state
 func fresh(other State) State {
 	return State{
-		Branches:              make(map[BranchKey]BranchValue, len(other.Branches)),
-		MergeablePullRequests: make(map[PullRequestNumber]CommitID, len(other.MergeablePullRequests)),
-		CancelledPullRequests: make(map[PullRequestNumber]struct{}, len(other.CancelledPullRequests)),
+		Branches:                 make(map[BranchKey]BranchValue, len(other.Branches)),
+		MergeablePullRequests:    make(map[PullRequestNumber]CommitID, len(other.MergeablePullRequests)),
+		ApprovalTimes:            make(map[PullRequestNumber]time.Time, len(other.ApprovalTimes)),
+		ApprovedHeads:            make(map[PullRequestNumber]CommitID, len(other.ApprovedHeads)),
+		PullRequestHeads:         make(map[PullRequestNumber]CommitID, len(other.PullRequestHeads)),
+		CancelledPullRequests:    make(map[PullRequestNumber]struct{}, len(other.CancelledPullRequests)),
+		BlockedPullRequests:      make(map[PullRequestNumber]string, len(other.BlockedPullRequests)),
+		PendingPullRequests:      make(map[PullRequestNumber]struct{}, len(other.PendingPullRequests)),
+		WaitingPullRequests:      make(map[PullRequestNumber][]PullRequestRef, len(other.WaitingPullRequests)),
+		StackedPullRequests:      make(map[PullRequestNumber][]PullRequestNumber, len(other.StackedPullRequests)),
+		PullRequestGroups:        make(map[PullRequestNumber]string, len(other.PullRequestGroups)),
+		FreezeExemptPullRequests: make(map[PullRequestNumber]struct{}, len(other.FreezeExemptPullRequests)),
+		FrozenPullRequests:       make(map[PullRequestNumber]struct{}, len(other.FrozenPullRequests)),
 	}
 }
 
@@ -264,13 +1415,45 @@ func deepCopy(other State) State {
 	for bk, bv := range other.Branches {
 		nbv := bv
 		nbv.Parents = append(make([]CommitID, 0, len(bv.Parents)), bv.Parents...)
+		nbv.MergedPullRequests = append([]MergedPullRequest(nil), bv.MergedPullRequests...)
 		ns.Branches[bk] = nbv
 	}
 	for number, c := range other.MergeablePullRequests {
 		ns.MergeablePullRequests[number] = c
 	}
+	for number, t := range other.ApprovalTimes {
+		ns.ApprovalTimes[number] = t
+	}
+	for number, head := range other.ApprovedHeads {
+		ns.ApprovedHeads[number] = head
+	}
+	for number, head := range other.PullRequestHeads {
+		ns.PullRequestHeads[number] = head
+	}
 	for number := range other.CancelledPullRequests {
 		ns.CancelledPullRequests[number] = struct{}{}
 	}
+	for number, reason := range other.BlockedPullRequests {
+		ns.BlockedPullRequests[number] = reason
+	}
+	for number := range other.PendingPullRequests {
+		ns.PendingPullRequests[number] = struct{}{}
+	}
+	for number, refs := range other.WaitingPullRequests {
+		ns.WaitingPullRequests[number] = append([]PullRequestRef(nil), refs...)
+	}
+	for number, deps := range other.StackedPullRequests {
+		ns.StackedPullRequests[number] = append([]PullRequestNumber(nil), deps...)
+	}
+	for number, group := range other.PullRequestGroups {
+		ns.PullRequestGroups[number] = group
+	}
+	ns.Freeze = other.Freeze
+	for number := range other.FreezeExemptPullRequests {
+		ns.FreezeExemptPullRequests[number] = struct{}{}
+	}
+	for number := range other.FrozenPullRequests {
+		ns.FrozenPullRequests[number] = struct{}{}
+	}
 	return ns
 }
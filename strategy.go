@@ -0,0 +1,126 @@
+package main
+
+// PipelineStrategy decides for which mergeable pull requests merge candidate
+// branches are created, and where, once the state machine has reached a
+// steady state.
+type PipelineStrategy interface {
+	// NextBatch returns the mergeable pull requests for which merge candidate
+	// branches should be created next, in the order in which they should be
+	// merged. Returns nil if none should be created.
+	NextBatch(s State, t PipelineTree) []PullRequestNumber
+
+	// CreateBranchesForBatch transitions the state to another (implicit) state
+	// in which the merge candidate branches for a batch returned by NextBatch
+	// have been created.
+	CreateBranchesForBatch(c GithubClient, s State, t PipelineTree, batch []PullRequestNumber)
+}
+
+// NewPipelineStrategy returns the PipelineStrategy selected in the
+// configuration.
+func NewPipelineStrategy(cfg Config) PipelineStrategy {
+	switch cfg.PipelineStrategy {
+	case PipelineStrategyBatch:
+		return batchStrategy{maxBatchSize: cfg.MaxBatchSize, fairShare: cfg.FairShare}
+	case PipelineStrategyHybrid:
+		return batchStrategy{maxBatchSize: cfg.MaxBatchSize, isPipelined: true, fairShare: cfg.FairShare}
+	default:
+		return pipelineStrategy{fairShare: cfg.FairShare}
+	}
+}
+
+// pipelineStrategy speculatively merges each pull request on its own, on top
+// of the base branch as well as on top of every commit in the build pipeline,
+// up to the limit of the fair share group of the pull request.
+type pipelineStrategy struct {
+	fairShare FairShare
+}
+
+var _ PipelineStrategy = pipelineStrategy{}
+
+func (pipelineStrategy) NextBatch(s State, t PipelineTree) []PullRequestNumber {
+	if number := s.NextMergeablePullRequest(t); number != 0 {
+		return []PullRequestNumber{number}
+	}
+	return nil
+}
+
+func (p pipelineStrategy) CreateBranchesForBatch(c GithubClient, s State, t PipelineTree, batch []PullRequestNumber) {
+	s.CreateBranchesForPullRequest(c, t, batch[0], p.fairShare.MaxSpeculativeBranches(s.PullRequestGroups[batch[0]]))
+}
+
+// batchStrategy merges batches of pull requests into single merge candidate
+// branches. When the check suites fail for a batch built off of the base
+// branch, the batch is bisected: its first half is retried as a new batch
+// while its second half goes back to the queue.
+// Unless it is pipelined, there is at most one batch in the build pipeline at
+// any time, and batches are built off of the base branch only. Otherwise,
+// batches are speculatively built off of every commit in the build pipeline,
+// like pipelineStrategy does for individual pull requests, up to the limit of
+// the fair share group of the first pull request in the batch.
+type batchStrategy struct {
+	maxBatchSize int
+	isPipelined  bool
+	fairShare    FairShare
+}
+
+var _ PipelineStrategy = batchStrategy{}
+
+func (b batchStrategy) NextBatch(s State, t PipelineTree) []PullRequestNumber {
+	if half := b.failedBatchHalf(s, t); len(half) > 0 {
+		return half
+	}
+	if !b.isPipelined {
+		for _, pv := range t {
+			if !pv.IsNotInPipeline {
+				return nil
+			}
+		}
+	}
+	return s.NextMergeablePullRequests(t, b.maxBatchSize, b.isPipelined)
+}
+
+func (b batchStrategy) CreateBranchesForBatch(c GithubClient, s State, _ PipelineTree, batch []PullRequestNumber) {
+	// Delete the failed batch which is being bisected, if any.
+	ns := deepCopy(s)
+	inBatch := make(map[PullRequestNumber]struct{}, len(batch))
+	for _, number := range batch {
+		inBatch[number] = struct{}{}
+	}
+	for _, bk := range ns.sortedBranchKeys() {
+		for _, number := range ns.Branches[bk].PullRequestNumbers(bk) {
+			if _, found := inBatch[number]; found {
+				c.DeleteBranch(bk)
+				delete(ns.Branches, bk)
+				break
+			}
+		}
+	}
+	maxSpeculativeBranches := b.fairShare.MaxSpeculativeBranches(s.PullRequestGroups[batch[0]])
+	ns.CreateBranchesForBatch(c, ns.BuildPipelineTree(), batch, b.isPipelined, maxSpeculativeBranches)
+}
+
+// failedBatchHalf returns the mergeable pull requests in the first half of
+// the first batch of more than one pull request whose check suites failed and
+// which was built off of the base branch, if any.
+func (b batchStrategy) failedBatchHalf(s State, t PipelineTree) []PullRequestNumber {
+	for _, bk := range s.sortedBranchKeys() {
+		bv := s.Branches[bk]
+		numbers := bv.PullRequestNumbers(bk)
+		if len(numbers) < 2 || !bv.IsCheckDone || bv.IsCheckPass {
+			continue
+		}
+		if pv, ok := t[bk]; !ok || pv.Predecessor != (BranchKey{}) {
+			continue
+		}
+		var half []PullRequestNumber
+		for _, number := range numbers[:len(numbers)/2] {
+			if _, ok := s.MergeablePullRequests[number]; ok {
+				half = append(half, number)
+			}
+		}
+		if len(half) > 0 {
+			return half
+		}
+	}
+	return nil
+}
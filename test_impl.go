@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,35 +16,64 @@ type TestMergeConflict struct {
 
 type TestComment struct {
 	PullRequestNumber
-	msg string
+	msg       string
+	author    string
+	createdAt time.Time
 }
 
 type TestPullRequest struct {
 	PullRequestNumber
 	CommitID
-	isMergeable bool
+	isMergeable           bool
+	isMergeabilityPending bool
+	isForOtherBase        bool
+	labels                []string
+	author                string
+	files                 []string
+	approvals             int
+	isChangesRequested    bool
+	checkPass             *bool
+	stackedOn             PullRequestNumber
 }
 
 // TestState mocks the state of the github repo.
 type TestState struct {
-	baseHead       CommitID
-	branches       map[BranchKey]BranchValue
-	mergeConflicts map[TestMergeConflict]struct{}
-	pullRequests   map[PullRequestNumber]TestPullRequest
-	comments       []TestComment
-	passingCommits map[CommitID]uint
-	failingCommits map[CommitID]uint
-	apiTrace       []string
+	baseHead           CommitID
+	branches           map[BranchKey]BranchValue
+	mergeConflicts     map[TestMergeConflict]struct{}
+	pullRequests       map[PullRequestNumber]TestPullRequest
+	comments           []TestComment
+	passingCommits     map[CommitID]uint
+	failingCommits     map[CommitID]uint
+	mergeStrategy      MergeStrategy
+	commitPullRequests map[CommitID][]PullRequestNumber
+	dependencies       map[PullRequestRef]DependencyStatus
+	// racingBasePush is pushed to the base branch right before the next
+	// fast-forward, if set.
+	racingBasePush CommitID
+	// racingPush is pushed to a pull request right before it next gets merged
+	// into a merge candidate branch, if set.
+	racingPush  *TestPushEvent
+	isFrozen    bool
+	maintainers map[string]struct{}
+	// now is the time of the latest comment or push.
+	now      time.Time
+	apiTrace []string
 }
 
 // TestGithubClient implements GithubClient for tests.
 type TestGithubClient struct {
-	*testing.T
+	testing.TB
 	TestState
 }
 
 var _ GithubClient = (*TestGithubClient)(nil)
 
+// QueueLabels identifies the merge queue of the test cases.
+func (t *TestGithubClient) QueueLabels() (repo, base string) {
+	return "owner/repo", testBaseBranch
+}
+
 func (t *TestGithubClient) GetBranch(bk BranchKey) BranchValue {
 	t.checkBranchExistence(bk)
 	bv := t.branches[bk]
@@ -50,7 +82,7 @@ func (t *TestGithubClient) GetBranch(bk BranchKey) BranchValue {
 			if counter <= 1 {
 				bv.IsCheckDone = true
 				bv.IsCheckPass = true
-				t.trace("checks pass for %s", bk.BranchName())
+				t.trace("checks pass for %s", bk.BranchName(testBaseBranch))
 			}
 			t.passingCommits[bv.CommitID] = counter - 1
 		}
@@ -58,7 +90,7 @@ func (t *TestGithubClient) GetBranch(bk BranchKey) BranchValue {
 			if counter <= 1 {
 				bv.IsCheckDone = true
 				bv.IsCheckPass = false
-				t.trace("checks fail for %s", bk.BranchName())
+				t.trace("checks fail for %s", bk.BranchName(testBaseBranch))
 			}
 			t.failingCommits[bv.CommitID] = counter - 1
 		}
@@ -68,7 +100,7 @@ func (t *TestGithubClient) GetBranch(bk BranchKey) BranchValue {
 }
 
 func (t *TestGithubClient) CreateBranch(bk BranchKey, sha CommitID) {
-	t.trace("create %s at %s", bk.BranchName(), sha)
+	t.trace("create %s at %s", bk.BranchName(testBaseBranch), sha)
 	t.checkBranchNonExistence(bk)
 	t.checkCommitExistence(sha)
 	if sha == t.baseHead {
@@ -91,43 +123,84 @@ func (t *TestGithubClient) CreateBranch(bk BranchKey, sha CommitID) {
 }
 
 func (t *TestGithubClient) DeleteBranch(bk BranchKey) {
-	t.trace("delete %s", bk.BranchName())
+	t.trace("delete %s", bk.BranchName(testBaseBranch))
 	t.checkBranchExistence(bk)
 	delete(t.branches, bk)
 }
 
-func (t *TestGithubClient) MergeBranch(bk BranchKey, sha CommitID) bool {
-	t.trace("merge %s into %s", sha, bk.BranchName())
+func (t *TestGithubClient) MergeBranch(bk BranchKey, prs []MergedPullRequest) MergeResult {
 	t.checkBranchExistence(bk)
-	t.checkCommitExistence(sha)
-	number := t.findMergeablePullRequest(sha)
-	if number != bk.PullRequestNumber {
-		t.Fatalf("branch is %s but merged commit %s is from #%d", bk.BranchName(), sha, number)
+	if prs[0].Number != bk.PullRequestNumber {
+		t.Fatalf("branch is %s but first merged pull request is #%d", bk.BranchName(testBaseBranch), prs[0].Number)
 	}
 	bv := t.branches[bk]
-	_, isConflict := t.mergeConflicts[TestMergeConflict{BranchKey: bk, PullRequestNumber: number}]
-	if isConflict {
-		t.branches[bk] = BranchValue{
-			CommitID: bv.CommitID,
-			Parents:  append([]CommitID{}, bv.Parents...),
+	numbers := make([]PullRequestNumber, len(prs))
+	for i, pr := range prs {
+		t.trace("merge %s into %s", pr.Head, bk.BranchName(testBaseBranch))
+		t.checkCommitExistence(pr.Head)
+		numbers[i] = t.findMergeablePullRequest(pr.Head)
+		if numbers[i] != pr.Number {
+			t.Fatalf("merged commit %s is from #%d, not #%d", pr.Head, numbers[i], pr.Number)
 		}
-		return false
+		_, isConflict := t.mergeConflicts[TestMergeConflict{BranchKey: bk, PullRequestNumber: pr.Number}]
+		if isConflict {
+			t.branches[bk] = BranchValue{
+				CommitID: bv.CommitID,
+				Parents:  append([]CommitID{}, bv.Parents...),
+			}
+			return MergeConflict
+		}
+		if t.racingPush != nil && PullRequestNumber(t.racingPush.PullRequest) == pr.Number {
+			t.ApplyEvent(TestStep{Push: t.racingPush})
+			t.racingPush = nil
+			if t.mergeStrategy == RebaseStrategy {
+				// The commits of the pull request are no longer those of the
+				// merged head.
+				t.branches[bk] = BranchValue{
+					CommitID: bv.CommitID,
+					Parents:  append([]CommitID{}, bv.Parents...),
+				}
+				return MergeStaleHead
+			}
+		}
+	}
+	head, parents := bv.CommitID, []CommitID(nil)
+	for _, pr := range prs {
+		head, parents = t.mergeCommit(head, pr.Head, pr.Number)
+	}
+	if len(prs) > 1 {
+		// Batches record the commit they were created at.
+		parents = []CommitID{bv.CommitID}
+		t.commitPullRequests[head] = numbers
 	}
 	t.branches[bk] = BranchValue{
-		CommitID:    testMergeCommitID(bv.CommitID, sha),
-		Parents:     []CommitID{bv.CommitID, sha},
-		isValid:     true,
-		IsCheckDone: false,
-		IsCheckPass: false,
+		CommitID:           head,
+		Parents:            parents,
+		MergedPullRequests: append([]MergedPullRequest{}, prs...),
+		isValid:            true,
+		IsCheckDone:        false,
+		IsCheckPass:        false,
 	}
-	return true
+	return Merged
+}
+
+// Now returns the time of the mock clock, see tick.
+func (t *TestGithubClient) Now() time.Time {
+	return t.now
 }
 
 func (t *TestGithubClient) GetBaseHead() CommitID {
 	return t.baseHead
 }
 
-func (t *TestGithubClient) FastForwardBase(sha CommitID) {
+func (t *TestGithubClient) FastForwardBase(old, sha CommitID) bool {
+	if t.racingBasePush != "" {
+		t.baseHead, t.racingBasePush = t.racingBasePush, ""
+	}
+	if t.baseHead != old {
+		t.trace("fast-forward to %s failed, base is %s instead of %s", sha, t.baseHead, old)
+		return false
+	}
 	t.trace("fast-forward to %s", sha)
 	t.checkCommitExistence(sha)
 	bkTarget, bvTarget := t.findBranch(sha)
@@ -138,51 +211,193 @@ func (t *TestGithubClient) FastForwardBase(sha CommitID) {
 		}
 		bk := *ff
 		bv := t.branches[bk]
-		for _, p := range bv.Parents {
-			if p == t.baseHead {
-				continue
-			}
+		for _, number := range t.commitPullRequests[bv.CommitID] {
 			// Mark PR as merged.
-			number := t.findMergeablePullRequest(p)
+			t.findMergeablePullRequest(t.pullRequests[number].CommitID)
 			pr := t.pullRequests[number]
 			pr.isMergeable = false
 			t.pullRequests[number] = pr
 		}
 		t.baseHead = bv.CommitID
 	}
+	return true
+}
+
+func (t *TestGithubClient) IsFrozen() bool {
+	return t.isFrozen
+}
+
+func (t *TestGithubClient) SetFrozen(frozen bool) {
+	if frozen {
+		t.trace("freeze")
+	} else {
+		t.trace("unfreeze")
+	}
+	t.isFrozen = frozen
 }
 
-func (t *TestGithubClient) GetMergeablePullRequestHead(number PullRequestNumber) *CommitID {
+func (t *TestGithubClient) GetPullRequest(_ context.Context, number PullRequestNumber) *PullRequest {
 	pr, ok := t.pullRequests[number]
-	if !ok || !pr.isMergeable {
+	if !ok {
 		return nil
 	}
-	return &pr.CommitID
+	if pr.isMergeabilityPending {
+		return &PullRequest{Number: number, Head: pr.CommitID, IsMergeabilityPending: true}
+	}
+	ret := &PullRequest{
+		Number:             number,
+		Head:               pr.CommitID,
+		IsOpen:             pr.isMergeable,
+		Labels:             append([]string{}, pr.labels...),
+		Author:             pr.author,
+		Files:              append([]string(nil), pr.files...),
+		Approvals:          pr.approvals,
+		IsChangesRequested: pr.isChangesRequested,
+		StackedOn:          pr.stackedOn,
+		IsForOtherBase:     pr.isForOtherBase,
+	}
+	if pr.checkPass != nil {
+		ret.IsCheckDone = true
+		ret.IsCheckPass = *pr.checkPass
+	}
+	return ret
 }
 
-func (t *TestGithubClient) ListAllCommentsSince(_ time.Duration, fn func(number PullRequestNumber, msg string)) {
+func (t *TestGithubClient) ListAllCommentsSince(_ time.Duration, fn func(number PullRequestNumber, msg, author string, createdAt time.Time)) {
 	for _, tc := range t.comments {
-		fn(tc.PullRequestNumber, tc.msg)
+		fn(tc.PullRequestNumber, tc.msg, tc.author, tc.createdAt)
 	}
 }
 
 func (t *TestGithubClient) ListAllMergeCandidateBranches(fn func(bk BranchKey)) {
+	// Github lists branches sorted by name.
+	names := make([]string, 0, len(t.branches))
+	keys := make(map[string]BranchKey, len(t.branches))
 	for bk := range t.branches {
-		fn(bk)
+		names = append(names, bk.BranchName(testBaseBranch))
+		keys[bk.BranchName(testBaseBranch)] = bk
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fn(keys[name])
+	}
+}
+
+func (t *TestGithubClient) PostComment(number PullRequestNumber, msg string) {
+	t.trace("comment on #%d: %s", number, strings.Split(msg, "\n")[0])
+	if _, ok := t.pullRequests[number]; !ok {
+		t.Fatalf("pull request #%d not found", number)
+	}
+	t.comments = append(t.comments, TestComment{
+		PullRequestNumber: number,
+		msg:               msg,
+		createdAt:         t.tick(),
+	})
+}
+
+func (t *TestGithubClient) IsMaintainer(login string) bool {
+	_, ok := t.maintainers[login]
+	return ok
+}
+
+func (t *TestGithubClient) GetDependencyStatus(ref PullRequestRef) DependencyStatus {
+	status, ok := t.dependencies[ref]
+	if !ok {
+		t.Fatalf("dependency %s not found", ref)
+	}
+	return status
+}
+
+// tick advances the mock clock by a minute, and returns the new time.
+func (t *TestState) tick() time.Time {
+	t.now = t.now.Add(time.Minute)
+	return t.now
+}
+
+// ApplyEvent changes the state of the github repo according to an event in a
+// test case scenario.
+func (t *TestGithubClient) ApplyEvent(step TestStep) {
+	switch {
+	case step.Comment != nil:
+		number := PullRequestNumber(step.Comment.PullRequest)
+		if _, ok := t.pullRequests[number]; !ok {
+			t.Fatalf("pull request #%d not found", number)
+		}
+		t.comments = append(t.comments, TestComment{
+			PullRequestNumber: number,
+			msg:               step.Comment.Message,
+			author:            step.Comment.Author,
+			createdAt:         t.tick(),
+		})
+	case step.Check != nil:
+		sha := CommitID(step.Check.Commit)
+		if step.Check.Branch != "" {
+			bk, ok := ParseBranchKey(step.Check.Branch)
+			if !ok {
+				t.Fatalf("invalid branch name %s", step.Check.Branch)
+			}
+			t.checkBranchExistence(bk)
+			sha = t.branches[bk].CommitID
+		}
+		// The outcome is reported the next time the branches get fetched.
+		for bk, bv := range t.branches {
+			if bv.CommitID == sha {
+				bv.IsCheckDone, bv.IsCheckPass = false, false
+				t.branches[bk] = bv
+			}
+		}
+		delete(t.passingCommits, sha)
+		delete(t.failingCommits, sha)
+		if step.Check.Pass {
+			t.passingCommits[sha] = 1
+		} else {
+			t.failingCommits[sha] = 1
+		}
+	case step.Push != nil:
+		number := PullRequestNumber(step.Push.PullRequest)
+		pr, ok := t.pullRequests[number]
+		if !ok {
+			t.Fatalf("pull request #%d not found", number)
+		}
+		pr.CommitID = CommitID(step.Push.Head)
+		t.tick()
+		t.pullRequests[number] = pr
+	case step.Close != 0:
+		number := PullRequestNumber(step.Close)
+		pr, ok := t.pullRequests[number]
+		if !ok {
+			t.Fatalf("pull request #%d not found", number)
+		}
+		pr.isMergeable = false
+		t.pullRequests[number] = pr
+	case step.PushBase != "":
+		t.baseHead = CommitID(step.PushBase)
+	case step.RacingPushBase != "":
+		t.racingBasePush = CommitID(step.RacingPushBase)
+	case step.RacingPush != nil:
+		t.racingPush = step.RacingPush
+	case step.Dependency != nil:
+		ref, ok := ParsePullRequestRef(step.Dependency.PullRequest)
+		if !ok {
+			t.Fatalf("invalid dependency %s", step.Dependency.PullRequest)
+		}
+		t.dependencies[ref] = step.Dependency.Status
+	default:
+		t.Fatalf("empty test step")
 	}
 }
 
 func (t *TestGithubClient) checkBranchExistence(bk BranchKey) {
 	_, ok := t.branches[bk]
 	if !ok {
-		t.Fatalf("branch %s not found", bk.BranchName())
+		t.Fatalf("branch %s not found", bk.BranchName(testBaseBranch))
 	}
 }
 
 func (t *TestGithubClient) checkBranchNonExistence(bk BranchKey) {
 	_, ok := t.branches[bk]
 	if ok {
-		t.Fatalf("branch %s already exists", bk.BranchName())
+		t.Fatalf("branch %s already exists", bk.BranchName(testBaseBranch))
 	}
 }
 
@@ -255,8 +470,30 @@ func (t *TestGithubClient) trace(fmtstr string, args ...interface{}) {
 	t.apiTrace = append(t.apiTrace, fmt.Sprintf(fmtstr, args...))
 }
 
-func testMergeCommitID(a, b CommitID) CommitID {
-	return CommitID(fmt.Sprintf("merge(%s, %s)", a, b))
+// mergeCommit returns the commit resulting from merging a pull request into
+// a merge candidate branch at the given head, along with its parents as
+// reported by GetBranch, according to the merge strategy.
+func (ts *TestState) mergeCommit(head, shaPR CommitID, number PullRequestNumber) (CommitID, []CommitID) {
+	sha := testCommitID(ts.mergeStrategy, head, shaPR)
+	parents := []CommitID{head}
+	if ts.mergeStrategy != SquashStrategy && ts.mergeStrategy != RebaseStrategy {
+		parents = append(parents, shaPR)
+	}
+	ts.commitPullRequests[sha] = []PullRequestNumber{number}
+	return sha, parents
+}
+
+// testCommitID names the commit resulting from merging a pull request into a
+// merge candidate branch at the given head, according to the merge strategy.
+func testCommitID(strategy MergeStrategy, head, shaPR CommitID) CommitID {
+	switch strategy {
+	case SquashStrategy:
+		return CommitID(fmt.Sprintf("squash(%s, %s)", head, shaPR))
+	case RebaseStrategy:
+		return CommitID(fmt.Sprintf("rebase(%s, %s)", head, shaPR))
+	default:
+		return CommitID(fmt.Sprintf("merge(%s, %s)", head, shaPR))
+	}
 }
 
 func testPRCommitID(number PullRequestNumber) CommitID {
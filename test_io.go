@@ -3,6 +3,7 @@ package main
 import (
 	"sort"
 	"testing"
+	"time"
 )
 
 // TestInputBranchValue defines the state of a merge candidate branch at the
@@ -33,41 +34,179 @@ type TestCaseInput struct {
 	// FailingCommits maps the number of iterations after which a check suite
 	// will pass for a given CommitID.
 	FailingCommits map[string]uint `yaml:"failing_commits,omitempty"`
+	// MergeConflicts defines the set of pull requests which would have a merge
+	// conflict with merge candidate branches which don't exist yet, by branch
+	// name.
+	MergeConflicts map[string][]int `yaml:"merge_conflicts,omitempty"`
 	// MergeablePullRequests holds the comments for mergeable pull requests.
 	MergeablePullRequests map[int][]string `yaml:"mergeable_prs,omitempty"`
 	// MergeablePullRequests holds the comments for unmergeable pull requests.
 	UnmergeablePullRequests map[int][]string `yaml:"unmergeable_prs,omitempty"`
+	// PullRequestHeads overrides the commit at the head of pull requests,
+	// which otherwise is the one merged into their merge candidate branches.
+	PullRequestHeads map[int]string `yaml:"pr_heads,omitempty"`
+	// PullRequestLabels holds the labels of pull requests.
+	PullRequestLabels map[int][]string `yaml:"pr_labels,omitempty"`
+	// PullRequestAuthors holds the logins of the authors of pull requests.
+	PullRequestAuthors map[int]string `yaml:"pr_authors,omitempty"`
+	// PullRequestFiles holds the paths of the files changed by pull requests.
+	PullRequestFiles map[int][]string `yaml:"pr_files,omitempty"`
+	// PullRequestApprovals holds the number of approvals of pull requests.
+	PullRequestApprovals map[int]int `yaml:"pr_approvals,omitempty"`
+	// PullRequestChangesRequested is the set of pull requests for which a
+	// reviewer requested changes.
+	PullRequestChangesRequested []int `yaml:"pr_changes_requested,flow,omitempty"`
+	// PullRequestCheckPass indicates whether the check suites passed for the
+	// head of pull requests, these are pending if absent.
+	PullRequestCheckPass map[int]bool `yaml:"pr_check_pass,omitempty"`
+	// PullRequestMergeabilityPending is the set of pull requests for which
+	// github never determines whether they have merge conflicts.
+	PullRequestMergeabilityPending []int `yaml:"pr_mergeability_pending,flow,omitempty"`
+	// PullRequestsForOtherBase is the set of pull requests which target
+	// another base branch than the merge queue's.
+	PullRequestsForOtherBase []int `yaml:"pr_other_base,flow,omitempty"`
+	// PullRequestStackedOn maps stacked pull requests to the pull requests
+	// whose head branch is their base branch.
+	PullRequestStackedOn map[int]int `yaml:"pr_stacked_on,omitempty"`
+	// Dependencies holds the status of the pull requests in other repos which
+	// pull requests depend on, by reference such as "org/repo#123".
+	Dependencies map[string]DependencyStatus `yaml:"dependencies,omitempty"`
+	// Frozen freezes the merge queue, as "bors freeze" would.
+	Frozen bool `yaml:"frozen,omitempty"`
+	// Maintainers holds the logins of the users with the admin or maintain
+	// permission on the repo, who may freeze the merge queue.
+	Maintainers []string `yaml:"maintainers,flow,omitempty"`
+	// Steps turn the test case into a scenario, in which the state machine
+	// runs several times with events happening in the github repo in between.
+	// Each run step produces a TestCaseOutput. Without steps, the state
+	// machine runs once.
+	Steps []TestStep `yaml:"steps,omitempty"`
+	// Config is the configuration of the repo, unmarshalled from the same
+	// yaml mapping as the rest of the test case input.
+	Config `yaml:",inline"`
+}
+
+// TestStep is a step in a test case scenario: either a run of the state
+// machine or exactly one event.
+type TestStep struct {
+	// Run runs the state machine.
+	Run bool `yaml:"run,omitempty"`
+	// Comment posts a comment on a pull request.
+	Comment *TestCommentEvent `yaml:"comment,omitempty"`
+	// Check completes the check suites for a commit.
+	Check *TestCheckEvent `yaml:"check,omitempty"`
+	// Push changes the head of a pull request.
+	Push *TestPushEvent `yaml:"push,omitempty"`
+	// Close closes a pull request.
+	Close int `yaml:"close,omitempty"`
+	// PushBase pushes a commit to the base branch, outside of the merge
+	// queue.
+	PushBase string `yaml:"push_base,omitempty"`
+	// RacingPushBase pushes a commit to the base branch outside of the merge
+	// queue right before the next fast-forward, which races with it.
+	RacingPushBase string `yaml:"racing_push_base,omitempty"`
+	// RacingPush changes the head of a pull request right before it next
+	// gets merged into a merge candidate branch, which races with the merge.
+	RacingPush *TestPushEvent `yaml:"racing_push,omitempty"`
+	// Dependency changes the status of a pull request in another repo.
+	Dependency *TestDependencyEvent `yaml:"dependency,omitempty"`
+}
+
+// TestCommentEvent is a comment posted on a pull request by a user.
+type TestCommentEvent struct {
+	PullRequest int    `yaml:"pr"`
+	Message     string `yaml:"msg"`
+	// Author is the login of the user who posts the comment.
+	Author string `yaml:"author,omitempty"`
+}
+
+// TestCheckEvent completes the check suites for the head of a merge candidate
+// branch, or for a commit which may later be at the head of one.
+type TestCheckEvent struct {
+	Branch string `yaml:"branch,omitempty"`
+	Commit string `yaml:"commit,omitempty"`
+	Pass   bool   `yaml:"pass"`
+}
+
+// TestDependencyEvent changes the status of a pull request in another repo,
+// which pull requests depend on.
+type TestDependencyEvent struct {
+	PullRequest string           `yaml:"pr"`
+	Status      DependencyStatus `yaml:"status"`
+}
+
+// TestPushEvent changes the head of a pull request.
+type TestPushEvent struct {
+	PullRequest int    `yaml:"pr"`
+	Head        string `yaml:"head"`
 }
 
 // testBaseHead is the name of the commit at the head of the base branch
 // at the beginning of the test case.
 const testBaseHead string = "main"
 
+// testStartTime is the time at the beginning of the test case. Comments and
+// pushes happen a minute apart afterwards.
+var testStartTime = time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+// testBaseBranch is the base branch of the merge queue of the test cases,
+// which names the merge candidate branches.
+const testBaseBranch string = "main"
+
 // NewTestGithubClient builds a TestGithubClient based off the input of a test
 // case.
-func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
+func (tc TestCaseInput) NewTestGithubClient(t testing.TB) TestGithubClient {
 	ts := TestState{
-		baseHead:       CommitID(testBaseHead),
-		branches:       map[BranchKey]BranchValue{},
-		mergeConflicts: map[TestMergeConflict]struct{}{},
-		pullRequests:   map[PullRequestNumber]TestPullRequest{},
-		comments:       []TestComment{},
-		passingCommits: map[CommitID]uint{},
-		failingCommits: map[CommitID]uint{},
+		baseHead:           CommitID(testBaseHead),
+		branches:           map[BranchKey]BranchValue{},
+		mergeConflicts:     map[TestMergeConflict]struct{}{},
+		pullRequests:       map[PullRequestNumber]TestPullRequest{},
+		comments:           []TestComment{},
+		passingCommits:     map[CommitID]uint{},
+		failingCommits:     map[CommitID]uint{},
+		mergeStrategy:      tc.MergeStrategy,
+		commitPullRequests: map[CommitID][]PullRequestNumber{},
+		dependencies:       map[PullRequestRef]DependencyStatus{},
+		isFrozen:           tc.Frozen,
+		maintainers:        map[string]struct{}{},
+		now:                testStartTime,
 	}
 
 	// Add pull requests and comments.
 	addPRAndComments := func(numberInt int, isMergeable bool, comments []string) {
 		number := PullRequestNumber(numberInt)
-		ts.pullRequests[number] = TestPullRequest{
+		head := testPRCommitID(number)
+		if sha, ok := tc.PullRequestHeads[numberInt]; ok {
+			head = CommitID(sha)
+		}
+		pr := TestPullRequest{
 			PullRequestNumber: number,
-			CommitID:          testPRCommitID(number),
+			CommitID:          head,
 			isMergeable:       isMergeable,
+			labels:            tc.PullRequestLabels[numberInt],
+			author:            tc.PullRequestAuthors[numberInt],
+			files:             tc.PullRequestFiles[numberInt],
+			approvals:         tc.PullRequestApprovals[numberInt],
+			stackedOn:         PullRequestNumber(tc.PullRequestStackedOn[numberInt]),
+		}
+		for _, n := range tc.PullRequestChangesRequested {
+			pr.isChangesRequested = pr.isChangesRequested || n == numberInt
+		}
+		for _, n := range tc.PullRequestMergeabilityPending {
+			pr.isMergeabilityPending = pr.isMergeabilityPending || n == numberInt
 		}
+		for _, n := range tc.PullRequestsForOtherBase {
+			pr.isForOtherBase = pr.isForOtherBase || n == numberInt
+		}
+		if checkPass, ok := tc.PullRequestCheckPass[numberInt]; ok {
+			pr.checkPass = &checkPass
+		}
+		ts.pullRequests[number] = pr
 		for _, comment := range comments {
 			ts.comments = append(ts.comments, TestComment{
 				PullRequestNumber: number,
 				msg:               comment,
+				createdAt:         ts.tick(),
 			})
 		}
 	}
@@ -78,6 +217,20 @@ func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
 		addPRAndComments(number, false, comments)
 	}
 
+	// Add maintainers.
+	for _, login := range tc.Maintainers {
+		ts.maintainers[login] = struct{}{}
+	}
+
+	// Add dependencies.
+	for k, status := range tc.Dependencies {
+		ref, ok := ParsePullRequestRef(k)
+		if !ok {
+			t.Fatalf("invalid dependency %s", k)
+		}
+		ts.dependencies[ref] = status
+	}
+
 	// Add passing and failing commits.
 	for sha, counter := range tc.PassingCommits {
 		ts.passingCommits[CommitID(sha)] = counter
@@ -87,6 +240,18 @@ func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
 	}
 
 	// Add branches and merge conflicts.
+	for k, numbers := range tc.MergeConflicts {
+		bk, ok := ParseBranchKey(k)
+		if !ok {
+			t.Fatalf("invalid branch name %s", k)
+		}
+		for _, numberInt := range numbers {
+			ts.mergeConflicts[TestMergeConflict{
+				BranchKey:         bk,
+				PullRequestNumber: PullRequestNumber(numberInt),
+			}] = struct{}{}
+		}
+	}
 	branchParent := map[BranchKey]BranchKey{}
 	for k, v := range tc.Branches {
 		bk, ok := ParseBranchKey(k)
@@ -126,7 +291,7 @@ func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
 	for {
 		flag := false
 		for bk, bv := range ts.branches {
-			if len(bv.Parents) > 0 {
+			if _, ok := toCommit[bk]; ok {
 				continue
 			}
 			bkParent := branchParent[bk]
@@ -136,15 +301,12 @@ func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
 			}
 			if bv.isValid {
 				shaPR := testPRCommitID(bk.PullRequestNumber)
-				bv.CommitID = testMergeCommitID(shaParent, shaPR)
-				bv.Parents = []CommitID{shaParent, shaPR}
+				bv.CommitID, bv.Parents = ts.mergeCommit(shaParent, shaPR, bk.PullRequestNumber)
+				bv.MergedPullRequests = []MergedPullRequest{{Number: bk.PullRequestNumber, Head: shaPR}}
 			} else {
-				bvParent := ts.branches[bkParent]
-				if bv.CommitID != shaParent {
-					t.Fatal("internal error")
-				}
-				bv.CommitID = bvParent.CommitID
-				bv.Parents = append(bv.Parents, bvParent.Parents...)
+				// The branch is still at the commit it was created at.
+				bv.CommitID = shaParent
+				bv.Parents = append(bv.Parents, ts.branches[bkParent].Parents...)
 			}
 			toCommit[bk] = bv.CommitID
 			ts.branches[bk] = bv
@@ -156,11 +318,11 @@ func (tc TestCaseInput) NewTestGithubClient(t *testing.T) TestGithubClient {
 	}
 	for bk, bv := range ts.branches {
 		if len(bv.CommitID) == 0 {
-			t.Fatalf("could not infer commit for branch %s", bk.BranchName())
+			t.Fatalf("could not infer commit for branch %s", bk.BranchName(testBaseBranch))
 		}
 	}
 
-	return TestGithubClient{T: t, TestState: ts}
+	return TestGithubClient{TB: t, TestState: ts}
 }
 
 // TestOutputBranchValue defines the final state of a merge candidate branch.
@@ -190,6 +352,29 @@ type TestCaseOutput struct {
 	ApiTrace []string `yaml:"api_trace,omitempty"`
 }
 
+// RunSteps runs the steps of a test case scenario and returns the output of
+// each run step, each with the trace of the API calls made during that run.
+func (tc TestCaseInput) RunSteps(c *TestGithubClient, commentLookback time.Duration) []TestCaseOutput {
+	steps := tc.Steps
+	if len(steps) == 0 {
+		steps = []TestStep{{Run: true}}
+	}
+	var outputs []TestCaseOutput
+	numTraced := 0
+	for _, step := range steps {
+		if !step.Run {
+			c.ApplyEvent(step)
+			continue
+		}
+		StateMachine(c, tc.Config, commentLookback, nil)
+		tco := c.ToTestCaseOutput()
+		tco.ApiTrace = tco.ApiTrace[numTraced:]
+		numTraced = len(c.apiTrace)
+		outputs = append(outputs, tco)
+	}
+	return outputs
+}
+
 // ToTestCaseOutput transforms the TestState into a serializable TestCaseOutput.
 func (ts TestState) ToTestCaseOutput() TestCaseOutput {
 	tco := TestCaseOutput{
@@ -212,7 +397,7 @@ func (ts TestState) ToTestCaseOutput() TestCaseOutput {
 			value := bv.IsCheckPass
 			tobv.CheckPass = &value
 		}
-		tco.Branches[bk.BranchName()] = tobv
+		tco.Branches[bk.BranchName(testBaseBranch)] = tobv
 	}
 	for number, pr := range ts.pullRequests {
 		if pr.isMergeable {
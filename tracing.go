@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+)
+
+// serviceName identifies the tool in the exported traces.
+const serviceName = "tentative-build-tool"
+
+// tracer creates the spans of the runs of the state machine and of the github
+// API calls. It uses the global tracer provider, see SetupTracing.
+var tracer = otel.Tracer("github.com/postamar/tentative-build-tool")
+
+// SetupTracing sets up the global tracer provider to export spans with OTLP
+// over HTTP if OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set, or otherwise as JSON to the file at TRACES_FILE if set. Otherwise
+// no spans are recorded.
+// Returns a function which flushes the remaining spans.
+func SetupTracing() (shutdown func()) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch {
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "":
+		exporter, err = otlptracehttp.New(context.Background())
+	case os.Getenv("TRACES_FILE") != "":
+		var f *os.File
+		f, err = os.OpenFile(os.Getenv("TRACES_FILE"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		onErrPanic(err)
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return func() {}
+	}
+	onErrPanic(err)
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	return func() {
+		onErrPanic(tp.Shutdown(context.Background()))
+	}
+}
+
+// endSpan ends a span, after recording the panic in progress if any, which
+// it then resumes. It must be deferred.
+func endSpan(span trace.Span) {
+	if r := recover(); r != nil {
+		span.RecordError(fmt.Errorf("%v", r))
+		span.SetStatus(codes.Error, fmt.Sprint(r))
+		span.End()
+		panic(r)
+	}
+	span.End()
+}
+
+// tracingTransport is an http.RoundTripper which traces the github API
+// requests, as children of the span in their context.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+func (tt tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := tt.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx, span := tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPTargetKey.String(req.URL.RequestURI())))
+	defer span.End()
+	resp, err := base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+	return resp, nil
+}
+
+// branchAttribute and pullRequestAttribute identify the merge candidate
+// branch or the pull request of a github API call in its span.
+func branchAttribute(name string) attribute.KeyValue {
+	return attribute.String("github.branch", name)
+}
+
+func pullRequestAttribute(number PullRequestNumber) attribute.KeyValue {
+	return attribute.Int("github.pr", int(number))
+}
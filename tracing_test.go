@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+	"testing"
+	"time"
+)
+
+var spanRecorder = tracetest.NewSpanRecorder()
+var setupSpanRecorder sync.Once
+
+// recordSpans records the spans ended while running fn. The spans of any other
+// test running concurrently are recorded as well.
+func recordSpans(fn func()) []sdktrace.ReadOnlySpan {
+	setupSpanRecorder.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	n := len(spanRecorder.Ended())
+	fn()
+	return spanRecorder.Ended()[n:]
+}
+
+// spanAttributes returns the attributes of a span as a map.
+func spanAttributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+// TestTracingStateMachine checks the spans of a run of the state machine on
+// the two_open_prs test case.
+func TestTracingStateMachine(t *testing.T) {
+	tci := readTestCaseInput(t, "two_open_prs")
+	c := tci.NewTestGithubClient(t)
+	spans := recordSpans(func() {
+		StateMachine(&c, tci.Config, time.Second, nil)
+	})
+
+	names := map[trace.SpanID]string{}
+	var root sdktrace.ReadOnlySpan
+	for _, s := range spans {
+		names[s.SpanContext().SpanID()] = s.Name()
+		if s.Name() == "StateMachine" {
+			require.Nil(t, root, "one StateMachine span")
+			root = s
+		}
+	}
+	require.NotNil(t, root)
+	require.False(t, root.Parent().IsValid())
+	parentName := func(s sdktrace.ReadOnlySpan) string {
+		return names[s.Parent().SpanID()]
+	}
+	numRootChildren, numCreated := 0, 0
+	for _, s := range spans {
+		require.Equal(t, root.SpanContext().TraceID(), s.SpanContext().TraceID())
+		switch s.Name() {
+		case "iteration", "CreateBranchesForBatch":
+			require.Equal(t, "StateMachine", parentName(s))
+			numRootChildren++
+		case "FetchMergeCandidateBranchState", "ToDecoratedWithPullRequests", "ToPrunedOrphanedBranches":
+			require.Equal(t, "iteration", parentName(s))
+		case "github.CreateBranch":
+			require.Equal(t, "CreateBranchesForBatch", parentName(s))
+			require.Contains(t, spanAttributes(s), attribute.Key("github.branch"))
+			numCreated++
+		case "github.FastForwardBase":
+			require.Equal(t, "FastForwardBase", parentName(s))
+		}
+	}
+	require.Equal(t, 6, numRootChildren)
+	require.Equal(t, 3, numCreated)
+}
+
+// TestTracingGithubClient checks the spans of the HTTP requests made by the
+// github client.
+func TestTracingGithubClient(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MergeRules = MergeRules{RequiredApprovals: 1, RequirePassingChecks: true}
+	c := newInstrumentedGithubClient(newCassetteClient(t, "get_pull_request_rules", cfg), nil)
+	spans := recordSpans(func() {
+		c.GetPullRequest(context.Background(), 1)
+	})
+
+	require.Len(t, spans, 4)
+	call := spans[len(spans)-1]
+	require.Equal(t, "github.GetPullRequest", call.Name())
+	require.Equal(t, attribute.IntValue(1), spanAttributes(call)["github.pr"])
+	require.Equal(t, attribute.IntValue(0), spanAttributes(call)["github.retries"])
+	for _, s := range spans[:3] {
+		require.Equal(t, "HTTP GET", s.Name())
+		require.Equal(t, call.SpanContext().SpanID(), s.Parent().SpanID())
+		require.Equal(t, attribute.IntValue(200), spanAttributes(s)["http.status_code"])
+	}
+}